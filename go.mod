@@ -1,21 +1,21 @@
 module github.com/metal-stack/firewall-policy-controller
 
-go 1.13
+go 1.16
 
 require (
+	github.com/coreos/go-systemd/v22 v22.3.2
 	github.com/ghodss/yaml v1.0.0
-	github.com/googleapis/gnostic v0.3.1 // indirect
+	github.com/google/nftables v0.1.0
 	github.com/metal-stack/v v1.0.2
 	github.com/mitchellh/go-homedir v1.1.0
+	github.com/prometheus/client_golang v1.11.1
 	github.com/spf13/cobra v0.0.6
 	github.com/spf13/viper v1.6.2
-	github.com/stretchr/testify v1.5.1
+	github.com/stretchr/testify v1.7.0
 	github.com/txn2/txeh v1.3.0
 	go.uber.org/zap v1.14.0
-	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073 // indirect
-	golang.org/x/net v0.0.0-20200301022130-244492dfa37a // indirect
-	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d // indirect
-	k8s.io/api v0.17.0
-	k8s.io/apimachinery v0.17.0
-	k8s.io/client-go v0.17.0
+	golang.org/x/sys v0.0.0-20211205182925-97ca703d548d
+	k8s.io/api v0.22.17
+	k8s.io/apimachinery v0.22.17
+	k8s.io/client-go v0.22.17
 )
@@ -1,33 +1,47 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"os/exec"
+	"net"
+	"net/http"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
 	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 
-	"io/ioutil"
 	"os"
 
+	"github.com/metal-stack/firewall-policy-controller/pkg/applier"
 	controller "github.com/metal-stack/firewall-policy-controller/pkg/controller"
+	"github.com/metal-stack/firewall-policy-controller/pkg/counters"
 	"github.com/metal-stack/firewall-policy-controller/pkg/droptailer"
-	"github.com/metal-stack/firewall-policy-controller/pkg/watcher"
+	"github.com/metal-stack/firewall-policy-controller/pkg/health"
+	"github.com/metal-stack/firewall-policy-controller/pkg/leader"
+	"github.com/metal-stack/firewall-policy-controller/pkg/probe"
+	"github.com/metal-stack/firewall-policy-controller/pkg/reconciler"
+	"github.com/metal-stack/firewall-policy-controller/pkg/status"
 	"github.com/metal-stack/v"
 
 	"github.com/mitchellh/go-homedir"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 const (
-	moduleName      = "firewall-policy-controller"
-	nftFile         = "/etc/nftables/firewall-policy-controller.v4"
-	nftBin          = "/usr/sbin/nft"
-	nftablesService = "nftables.service"
-	systemctlBin    = "/bin/systemctl"
+	moduleName = "firewall-policy-controller"
 )
 
 var rootCmd = &cobra.Command{
@@ -39,10 +53,23 @@ var rootCmd = &cobra.Command{
 	},
 }
 
-var logger *zap.SugaredLogger
+var confirmDeletionCmd = &cobra.Command{
+	Use:   "confirm-deletion",
+	Short: "confirm the blocked change that removes more rules than the deletion limits allow",
+	Run: func(cmd *cobra.Command, args []string) {
+		confirmDeletion()
+	},
+}
+
+var (
+	logger   *zap.SugaredLogger
+	logLevel = zap.NewAtomicLevel()
+)
 
 func main() {
-	zap, _ := zap.NewProduction()
+	config := zap.NewProductionConfig()
+	config.Level = logLevel
+	zap, _ := config.Build()
 	defer func() {
 		_ = zap.Sync()
 	}()
@@ -59,8 +86,40 @@ func init() {
 		logger.Fatal(err)
 	}
 	rootCmd.PersistentFlags().StringP("kubecfg", "k", homedir+"/.kube/config", "kubecfg path to the cluster to account")
+	rootCmd.PersistentFlags().String("log-level", "info", "minimum level of the logs, \"debug\" also logs every rule when the rules change")
 	rootCmd.PersistentFlags().Bool("dry-run", false, "just print the rules that would be enforced without applying them")
-	rootCmd.PersistentFlags().Duration("fetch-interval", 10*time.Second, "interval for reassembling firewall rules")
+	rootCmd.PersistentFlags().Duration("fetch-interval", 10*time.Second, "interval for resyncing the informer caches and reassembling firewall rules")
+	rootCmd.PersistentFlags().StringSlice("policy-namespaces", nil, "namespaces whose network policies are enforced, the network policies of all namespaces are enforced with a warning if neither this, policy-namespace-selector nor all-policy-namespaces is given")
+	rootCmd.PersistentFlags().String("policy-namespace-selector", "", "label selector for namespaces whose network policies are enforced")
+	rootCmd.PersistentFlags().Bool("all-policy-namespaces", false, "enforce the network policies of all namespaces, must not be combined with policy-namespaces and policy-namespace-selector")
+	rootCmd.PersistentFlags().Duration("resolve-interval", time.Minute, "interval for resolving the host names of load balancers again")
+	rootCmd.PersistentFlags().String("render-mode", string(controller.RenderModeRules), "how the rules for services are rendered, \"rules\" for a rule per service or \"maps\" for named sets and verdict maps that scale to large numbers of services")
+	rootCmd.PersistentFlags().String("applier", "file", "how the rules are applied, \"file\" for nftables files that are loaded by reloading nftables.service or \"netlink\" for replacing the firewall tables over netlink without nft and systemctl")
+	rootCmd.PersistentFlags().Bool("probe-apiserver", false, "confirm applied rules by checking that the kube-apiserver is reachable, rules are rolled back to the last confirmed rules otherwise")
+	rootCmd.PersistentFlags().StringSlice("probe-tcp", nil, "addresses (host:port) that must accept tcp connections to confirm applied rules")
+	rootCmd.PersistentFlags().StringSlice("probe-icmp", nil, "hosts that must answer echo requests to confirm applied rules")
+	rootCmd.PersistentFlags().Duration("probe-timeout", 30*time.Second, "time for the probes to succeed after rules were applied before they are rolled back")
+	rootCmd.PersistentFlags().Duration("probe-interval", 2*time.Second, "interval for repeating failed probes")
+	rootCmd.PersistentFlags().Duration("rollback-backoff", 5*time.Minute, "time after which rolled back rules are applied again, doubled for every further rollback of the same rules up to an hour")
+	rootCmd.PersistentFlags().String("confirmed-rules-file", "/var/lib/firewall-policy-controller/confirmed-rules.json", "file that keeps the last rules confirmed by the probes, so they can be restored after a restart, not kept if empty")
+	rootCmd.PersistentFlags().Duration("max-staleness", 0, "time after which the stale policy applies if k8s entities cannot be fetched, the last good rules are kept forever if zero")
+	rootCmd.PersistentFlags().String("stale-policy", string(reconciler.StalePolicyKeep), "rules that are enforced once the maximum staleness is reached, \"keep\" for the last good rules, \"open\" for accepting all traffic or \"closed\" for removing all dynamic rules")
+	rootCmd.PersistentFlags().Int("max-deleted-rules", 0, "maximum number of rules a change may remove before it is blocked, not limited if zero")
+	rootCmd.PersistentFlags().Int("max-deleted-rules-percent", 0, "maximum percentage of rules a change may remove before it is blocked, not limited if zero")
+	rootCmd.PersistentFlags().Bool("allow-mass-deletion", false, "apply changes that exceed the deletion limits without confirmation")
+	rootCmd.PersistentFlags().String("deletion-guard-configmap", "", "config map (namespace/name) for reporting blocked changes and confirming them with the annotation "+applier.AnnotationConfirmedChange+" or the confirm-deletion command")
+	rootCmd.PersistentFlags().Bool("leader-election", false, "elect a leader among the firewalls of the cluster, which publishes the desired ruleset that the other firewalls verify they converge to")
+	rootCmd.PersistentFlags().String("leader-election-id", "", "identity of this firewall in the leader election, the host name if not given")
+	rootCmd.PersistentFlags().String("leader-election-lease", "firewall/firewall-policy-controller", "lease (namespace/name) that is used for the leader election")
+	rootCmd.PersistentFlags().String("desired-ruleset-configmap", "firewall-policy-controller-ruleset", "name of the config map in the namespace of the lease that holds the desired ruleset")
+	rootCmd.PersistentFlags().Duration("convergence-timeout", time.Minute, "time a firewall may apply another ruleset than the desired one before the divergence is reported")
+	rootCmd.PersistentFlags().Bool("report-status", true, "write the enforcement status of services and network policies to their annotations and record events when it changes, only the leader reports if leader election is enabled")
+	rootCmd.PersistentFlags().String("status-configmap", "firewall/firewall-policy-controller-status", "config map (namespace/name) that holds the revision of the ruleset whose enforcement status was reported last, not recorded if empty")
+	rootCmd.PersistentFlags().String("http-listen-address", ":2112", "address of the http server that serves the prometheus metrics at /metrics, the liveness at /healthz and the readiness at /readyz, disabled if empty")
+	rootCmd.PersistentFlags().Duration("stall-timeout", 2*time.Minute, "time without finished reconciliation after which the controller is not alive anymore and stops pinging the systemd watchdog, and without successful reconciliation after which it is not ready anymore, reconciliations are triggered at least every quarter of it even without changes")
+	rootCmd.PersistentFlags().Duration("counters-interval", 30*time.Second, "interval for reading the counters of the firewall rules, which are exported as metrics by service and network policy, disabled if zero")
+	rootCmd.PersistentFlags().String("dns-server", "", "dns server (host:port) for resolving the host names of load balancers, the system resolver is used if not given")
+	rootCmd.AddCommand(confirmDeletionCmd)
 	viper.AutomaticEnv()
 	err = viper.BindPFlags(rootCmd.PersistentFlags())
 	if err != nil {
@@ -69,89 +128,244 @@ func init() {
 }
 
 func run() {
+	err := logLevel.UnmarshalText([]byte(viper.GetString("log-level")))
+	if err != nil {
+		logger.Errorw("invalid log level", "level", viper.GetString("log-level"), "error", err)
+		os.Exit(1)
+	}
 	client, err := loadClient(viper.GetString("kubecfg"))
 	if err != nil {
 		logger.Errorw("unable to connect to k8s", "error", err)
 		os.Exit(1)
 	}
-	ctr := controller.NewFirewallController(client, logger)
-	svcWatcher := watcher.NewServiceWatcher(logger, client)
-	npWatcher := watcher.NewNetworkPolicyWatcher(logger, client)
+	config := controller.Config{
+		AllPolicyNamespaces: viper.GetBool("all-policy-namespaces"),
+		PolicyNamespaces:    viper.GetStringSlice("policy-namespaces"),
+		ResolveInterval:     viper.GetDuration("resolve-interval"),
+		RenderMode:          controller.RenderMode(viper.GetString("render-mode")),
+	}
+	if config.RenderMode != controller.RenderModeRules && config.RenderMode != controller.RenderModeMaps {
+		logger.Errorw("invalid render mode", "mode", config.RenderMode)
+		os.Exit(1)
+	}
+	if server := viper.GetString("dns-server"); server != "" {
+		config.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{}
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	if s := viper.GetString("policy-namespace-selector"); s != "" {
+		config.PolicyNamespaceSelector, err = labels.Parse(s)
+		if err != nil {
+			logger.Errorw("invalid policy namespace selector", "selector", s, "error", err)
+			os.Exit(1)
+		}
+	}
+	switch {
+	case config.AllPolicyNamespaces && (len(config.PolicyNamespaces) > 0 || config.PolicyNamespaceSelector != nil):
+		logger.Errorw("all-policy-namespaces must not be combined with policy-namespaces and policy-namespace-selector")
+		os.Exit(1)
+	case !config.AllPolicyNamespaces && len(config.PolicyNamespaces) == 0 && config.PolicyNamespaceSelector == nil:
+		// earlier versions enforced the network policies of all namespaces without configuration
+		logger.Warnw("the namespaces whose network policies are enforced are not configured, enforcing the network policies of all namespaces, set policy-namespaces, policy-namespace-selector or all-policy-namespaces to silence this warning")
+		config.AllPolicyNamespaces = true
+	}
+	var a applier.Applier
+	switch viper.GetString("applier") {
+	case "file":
+		a = applier.NewFileApplier(logger)
+	case "netlink":
+		a = applier.NewNetlinkApplier(logger)
+	default:
+		logger.Errorw("invalid applier", "applier", viper.GetString("applier"))
+		os.Exit(1)
+	}
+	// the applied rules are mapped to the handles by the applier that loads them, not by the appliers that wrap it
+	handleRecorder, _ := a.(applier.HandleRecorder)
+	// the counters are only attributed to single services and network policies if their rules are kept apart
+	config.ObjectCounters = viper.GetDuration("counters-interval") > 0 && handleRecorder != nil
+	probes := []probe.Probe{}
+	if viper.GetBool("probe-apiserver") {
+		probes = append(probes, probe.NewAPIServer(client))
+	}
+	for _, address := range viper.GetStringSlice("probe-tcp") {
+		probes = append(probes, probe.NewTCP(address))
+	}
+	for _, host := range viper.GetStringSlice("probe-icmp") {
+		probes = append(probes, probe.NewICMP(host))
+	}
+	if len(probes) > 0 {
+		a = applier.NewConfirmingApplier(logger, a, probes, viper.GetDuration("probe-timeout"), viper.GetDuration("probe-interval"), viper.GetDuration("rollback-backoff"), viper.GetString("confirmed-rules-file"))
+	}
+	limits := applier.DeletionLimits{
+		MaxCount:   viper.GetInt("max-deleted-rules"),
+		MaxPercent: viper.GetInt("max-deleted-rules-percent"),
+	}
+	if (limits.MaxCount > 0 || limits.MaxPercent > 0) && !viper.GetBool("allow-mass-deletion") {
+		var confirmer applier.Confirmer
+		if cm := viper.GetString("deletion-guard-configmap"); cm != "" {
+			confirmer, err = configMapConfirmer(client, cm)
+			if err != nil {
+				logger.Errorw("invalid deletion guard config map", "error", err)
+				os.Exit(1)
+			}
+		}
+		a = applier.NewGuardedApplier(logger, a, limits, confirmer)
+	}
+	var leading func() bool
+	if viper.GetBool("leader-election") {
+		coordinator, err := newCoordinator(client)
+		if err != nil {
+			logger.Errorw("invalid leader election configuration", "error", err)
+			os.Exit(1)
+		}
+		a = coordinator.Applier(a)
+		leading = coordinator.Leading
+		prometheus.MustRegister(coordinator)
+		go coordinator.Run(context.Background())
+	}
+	stalePolicy := reconciler.StalePolicy(viper.GetString("stale-policy"))
+	if stalePolicy != reconciler.StalePolicyKeep && stalePolicy != reconciler.StalePolicyOpen && stalePolicy != reconciler.StalePolicyClosed {
+		logger.Errorw("invalid stale policy", "policy", stalePolicy)
+		os.Exit(1)
+	}
+	factory := informers.NewSharedInformerFactory(client, viper.GetDuration("fetch-interval"))
+	ctr := controller.NewFirewallController(factory, logger, config)
+	recConfig := reconciler.Config{
+		DryRun:       viper.GetBool("dry-run"),
+		MaxStaleness: viper.GetDuration("max-staleness"),
+		StalePolicy:  stalePolicy,
+		Debounce:     3 * time.Second,
+		Heartbeat:    viper.GetDuration("stall-timeout") / 4,
+	}
+	if viper.GetBool("report-status") {
+		broadcaster := record.NewBroadcaster()
+		broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events(metav1.NamespaceAll)})
+		hostname, _ := os.Hostname()
+		recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: moduleName, Host: hostname})
+		var namespace, configMap string
+		if cm := viper.GetString("status-configmap"); cm != "" {
+			namespace, configMap, err = namespacedName(cm)
+			if err != nil {
+				logger.Errorw("invalid status config map", "error", err)
+				os.Exit(1)
+			}
+		}
+		recConfig.Reporter = status.NewReporter(logger, client, factory, recorder, leading, namespace, configMap)
+	}
+	rec := reconciler.New(logger, ctr, a, recConfig)
+	stop := make(chan struct{})
 	dropTailer, err := droptailer.NewDropTailer(logger, client)
 	if err != nil {
 		logger.Errorw("unable to create droptailer client", "error", err)
 		os.Exit(1)
 	}
 
-	// watch for services and network policies
-	c := make(chan bool)
-	go svcWatcher.Watch(c)
-	go npWatcher.Watch(c)
+	if config.ObjectCounters {
+		exporter := counters.NewExporter(logger, viper.GetDuration("counters-interval"), handleRecorder.Handles)
+		prometheus.MustRegister(exporter)
+		go exporter.Run(stop)
+	}
+	checker := health.NewChecker(logger, health.Config{
+		Synced:        ctr.HasSynced,
+		LastSuccess:   rec.LastSuccess,
+		LastReconcile: rec.LastReconcile,
+		StallTimeout:  viper.GetDuration("stall-timeout"),
+	})
+	go checker.Notify(stop)
+	if addr := viper.GetString("http-listen-address"); addr != "" {
+		go serveHTTP(addr, checker)
+	}
+
+	// watch for services, network policies, the pods and namespaces they select and the nodes that serve node ports,
+	// the informers also resync regularly, which triggers the assembly of the rules
+	ctr.AddEventHandler(rec.EventHandler())
+	ctr.OnHostsResolved(rec.Enqueue)
+	factory.Start(stop)
 	go dropTailer.WatchServerIP()
 	go dropTailer.WatchClientSecret()
 
-	// regularly trigger fetch of k8s resources
-	go func() {
-		t := time.NewTicker(viper.GetDuration("fetch-interval"))
-		for {
-			<-t.C
-			c <- true
-		}
-	}()
+	logger.Info("waiting for the caches to sync")
+	if !cache.WaitForCacheSync(stop, ctr.HasSynced) {
+		logger.Error("unable to sync caches")
+		os.Exit(1)
+	}
+	rec.Enqueue()
+	rec.Run(stop)
+}
 
-	// debounce events and handle fetch
-	d := time.Second * 3
-	t := time.NewTimer(d)
-	var old *controller.FirewallRules
-	var new *controller.FirewallRules
-	for {
-		select {
-		case <-c:
-			t.Reset(d)
-		case <-t.C:
-			new, err = ctr.FetchAndAssemble()
-			if err != nil {
-				logger.Errorw("could not fetch k8s entities to build firewall rules", "error", err)
-			}
-			if !new.HasChanged(old) {
-				old = new
-				continue
-			}
-			old = new
-			logger.Infow("new fw rules to enforce", "ingress", len(new.IngressRules), "egress", len(new.EgressRules))
-			for k, i := range new.IngressRules {
-				fmt.Printf("%d ingress: %s\n", k+1, i)
-			}
-			for k, e := range new.EgressRules {
-				fmt.Printf("%d egress: %s\n", k+1, e)
-			}
-			if !viper.GetBool("dry-run") {
-				rs, err := new.Render()
-				if err != nil {
-					logger.Errorw("error rendering nftables rules", "error", err)
-					continue
-				}
-				err = ioutil.WriteFile(nftFile, []byte(rs), 0644)
-				if err != nil {
-					logger.Errorw("error writing nftables file", "file", nftFile, "error", err)
-					continue
-				}
-				c := exec.Command(nftBin, "-c", "-f", nftFile)
-				out, err := c.Output()
-				if err != nil {
-					logger.Errorw("nftables file is invalid", "file", nftFile, "error", fmt.Sprint(out))
-					continue
-				}
-				c = exec.Command(systemctlBin, "reload", nftablesService)
-				err = c.Run()
-				if err != nil {
-					logger.Errorw("nftables.service file could not be reloaded")
-					continue
-				}
-				logger.Info("applied new set of nftable rules")
-			}
+func serveHTTP(addr string, checker *health.Checker) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", checker.LivenessHandler())
+	mux.Handle("/readyz", checker.ReadinessHandler())
+	logger.Infow("serving metrics and health", "address", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		logger.Errorw("unable to serve metrics and health", "error", err)
+		os.Exit(1)
+	}
+}
+
+func confirmDeletion() {
+	client, err := loadClient(viper.GetString("kubecfg"))
+	if err != nil {
+		logger.Errorw("unable to connect to k8s", "error", err)
+		os.Exit(1)
+	}
+	confirmer, err := configMapConfirmer(client, viper.GetString("deletion-guard-configmap"))
+	if err != nil {
+		logger.Errorw("invalid deletion guard config map", "error", err)
+		os.Exit(1)
+	}
+	hash, err := confirmer.Confirm()
+	if err != nil {
+		logger.Errorw("unable to confirm blocked change", "error", err)
+		os.Exit(1)
+	}
+	logger.Infow("confirmed blocked change", "hash", hash)
+}
+
+func configMapConfirmer(client k8s.Interface, cm string) (*applier.ConfigMapConfirmer, error) {
+	namespace, name, err := namespacedName(cm)
+	if err != nil {
+		return nil, fmt.Errorf("config map %w", err)
+	}
+	return applier.NewConfigMapConfirmer(client, namespace, name), nil
+}
+
+func newCoordinator(client k8s.Interface) (*leader.Coordinator, error) {
+	namespace, lease, err := namespacedName(viper.GetString("leader-election-lease"))
+	if err != nil {
+		return nil, fmt.Errorf("lease %w", err)
+	}
+	identity := viper.GetString("leader-election-id")
+	if identity == "" {
+		identity, err = os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine identity: %w", err)
 		}
 	}
+	return leader.New(logger, client, leader.Config{
+		Identity:           identity,
+		Namespace:          namespace,
+		Lease:              lease,
+		ConfigMap:          viper.GetString("desired-ruleset-configmap"),
+		ConvergenceTimeout: viper.GetDuration("convergence-timeout"),
+		VerifyInterval:     viper.GetDuration("fetch-interval"),
+	}), nil
+}
+
+// namespacedName splits s that is given as namespace/name.
+func namespacedName(s string) (string, string, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("%q is not given as namespace/name", s)
+	}
+	return parts[0], parts[1], nil
 }
 
 func loadClient(kubeconfigPath string) (*k8s.Clientset, error) {
@@ -0,0 +1,61 @@
+// Package applier applies the assembled firewall rules to the nftables ruleset of the host.
+package applier
+
+import (
+	"errors"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+)
+
+// Applier applies firewall rules to the host.
+type Applier interface {
+	// Apply replaces the firewall tables of the host with tables that hold the rules.
+	Apply(rules *controller.FirewallRules) error
+}
+
+// Stages in which applying rules fails.
+const (
+	// StageRender is the rendering of the rules to nftables files or netlink messages.
+	StageRender = "render"
+	// StageCheck is the validation of the rendered rules with nft.
+	StageCheck = "check"
+	// StageReload is the loading of the rules into the kernel.
+	StageReload = "reload"
+	// StageConfirm is the confirmation of the applied rules with probes.
+	StageConfirm = "confirm"
+	// StageBlocked is the deletion guard that blocks changes which remove too many rules.
+	StageBlocked = "blocked"
+	// StageUnknown is used for errors that do not belong to a stage.
+	StageUnknown = "unknown"
+)
+
+// StageError is returned if applying rules failed in a stage.
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// Stage returns the stage in which applying rules failed with the error.
+func Stage(err error) string {
+	var stageErr *StageError
+	if errors.As(err, &stageErr) {
+		return stageErr.Stage
+	}
+	var rollbackErr *RollbackError
+	if errors.As(err, &rollbackErr) {
+		return StageConfirm
+	}
+	var blockedErr *BlockedError
+	if errors.As(err, &blockedErr) {
+		return StageBlocked
+	}
+	return StageUnknown
+}
@@ -0,0 +1,25 @@
+package applier
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestStage(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: fmt.Errorf("error writing nftables file: %w", &StageError{Stage: StageCheck, Err: errors.New("invalid")}), want: StageCheck},
+		{err: &StageError{Stage: StageReload, Err: errors.New("reload failed")}, want: StageReload},
+		{err: &RollbackError{Err: errors.New("probe failed")}, want: StageConfirm},
+		{err: &BlockedError{Hash: "abc", Removed: 10, Total: 10}, want: StageBlocked},
+		{err: errors.New("other"), want: StageUnknown},
+	}
+	for _, tt := range tests {
+		if got := Stage(tt.err); got != tt.want {
+			t.Errorf("Stage(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
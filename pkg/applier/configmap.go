@@ -0,0 +1,105 @@
+package applier
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+const (
+	// AnnotationBlockedChange holds the hash of the rules of a blocked change.
+	AnnotationBlockedChange = "firewall.metal-stack.io/blocked-change"
+	// AnnotationBlockedReason describes why the change is blocked.
+	AnnotationBlockedReason = "firewall.metal-stack.io/blocked-reason"
+	// AnnotationConfirmedChange holds the hash of the rules of a blocked change that may be applied.
+	AnnotationConfirmedChange = "firewall.metal-stack.io/confirmed-change"
+)
+
+// ConfigMapConfirmer reports blocked changes with annotations of a config map and reads their confirmation
+// from it. A change is confirmed by setting the confirmed change annotation to the hash of the blocked change.
+type ConfigMapConfirmer struct {
+	client    k8s.Interface
+	namespace string
+	name      string
+}
+
+// NewConfigMapConfirmer creates a new ConfigMapConfirmer
+func NewConfigMapConfirmer(client k8s.Interface, namespace, name string) *ConfigMapConfirmer {
+	return &ConfigMapConfirmer{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+// Confirmed checks whether the confirmed change annotation holds the hash.
+func (c *ConfigMapConfirmer) Confirmed(hash string) (bool, error) {
+	cm, err := c.client.CoreV1().ConfigMaps(c.namespace).Get(context.Background(), c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return cm.ObjectMeta.Annotations[AnnotationConfirmedChange] == hash, nil
+}
+
+// Report sets or removes the blocked change annotations, the config map is created if it does not exist.
+func (c *ConfigMapConfirmer) Report(blocked *BlockedError) error {
+	cms := c.client.CoreV1().ConfigMaps(c.namespace)
+	cm, err := cms.Get(context.Background(), c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if blocked == nil {
+			return nil
+		}
+		cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: c.namespace, Name: c.name}}
+		cm.ObjectMeta.Annotations = map[string]string{
+			AnnotationBlockedChange: blocked.Hash,
+			AnnotationBlockedReason: blocked.Error(),
+		}
+		_, err = cms.Create(context.Background(), cm, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if cm.ObjectMeta.Annotations == nil {
+		cm.ObjectMeta.Annotations = map[string]string{}
+	}
+	if blocked == nil {
+		delete(cm.ObjectMeta.Annotations, AnnotationBlockedChange)
+		delete(cm.ObjectMeta.Annotations, AnnotationBlockedReason)
+		delete(cm.ObjectMeta.Annotations, AnnotationConfirmedChange)
+	} else {
+		if cm.ObjectMeta.Annotations[AnnotationBlockedChange] == blocked.Hash {
+			return nil
+		}
+		cm.ObjectMeta.Annotations[AnnotationBlockedChange] = blocked.Hash
+		cm.ObjectMeta.Annotations[AnnotationBlockedReason] = blocked.Error()
+	}
+	_, err = cms.Update(context.Background(), cm, metav1.UpdateOptions{})
+	return err
+}
+
+// Confirm confirms the change that is currently blocked and returns its hash.
+func (c *ConfigMapConfirmer) Confirm() (string, error) {
+	cms := c.client.CoreV1().ConfigMaps(c.namespace)
+	cm, err := cms.Get(context.Background(), c.name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	hash := cm.ObjectMeta.Annotations[AnnotationBlockedChange]
+	if hash == "" {
+		return "", fmt.Errorf("no change is blocked")
+	}
+	cm.ObjectMeta.Annotations[AnnotationConfirmedChange] = hash
+	_, err = cms.Update(context.Background(), cm, metav1.UpdateOptions{})
+	if err != nil {
+		return "", err
+	}
+	return hash, nil
+}
@@ -0,0 +1,223 @@
+package applier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+	"github.com/metal-stack/firewall-policy-controller/pkg/metrics"
+	"github.com/metal-stack/firewall-policy-controller/pkg/probe"
+)
+
+// Rollback records why applied rules were replaced with the last known-good rules.
+type Rollback struct {
+	Time   time.Time
+	Reason string
+	// Rules are the rules that were rolled back
+	Rules *controller.FirewallRules
+	// Retry is the time after which the rules are applied again
+	Retry time.Time
+}
+
+// RollbackError is returned for rules that failed the health probes after they were applied.
+type RollbackError struct {
+	Rollback
+	// Err is set if the last known-good rules could not be applied again
+	Err error
+}
+
+func (e *RollbackError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("rules failed health probes: %s, restoring the last known-good rules failed: %s", e.Reason, e.Err)
+	}
+	return fmt.Sprintf("rules failed health probes and were rolled back: %s", e.Reason)
+}
+
+// ConfirmingApplier applies rules with another applier and confirms them with health probes. If the probes
+// do not succeed within the timeout, the last known-good rules are applied again. Rules that were rolled back
+// are not applied again until they change or the backoff passed, because the probes may have failed for reasons
+// outside of the rules. The backoff doubles with every rollback of the same rules. If the known-good rules could
+// not be restored, the rules are applied again with the next call. The known-good rules are persisted to a file,
+// so they can be restored after a restart as well.
+type ConfirmingApplier struct {
+	applier  Applier
+	probes   []probe.Probe
+	timeout  time.Duration
+	interval time.Duration
+	backoff  time.Duration
+	file     string
+	logger   *zap.SugaredLogger
+	now      func() time.Time
+
+	mu       sync.Mutex
+	good     *controller.FirewallRules
+	rollback *Rollback
+	// rollbacks counts the consecutive rollbacks of the same rules
+	rollbacks int
+}
+
+// maxRollbackBackoff limits the backoff after which rolled back rules are applied again.
+const maxRollbackBackoff = time.Hour
+
+// NewConfirmingApplier creates a new ConfirmingApplier, the known-good rules are read from and written to the
+// file if it is given. Rolled back rules are applied again after the backoff.
+func NewConfirmingApplier(logger *zap.SugaredLogger, applier Applier, probes []probe.Probe, timeout, interval, backoff time.Duration, file string) *ConfirmingApplier {
+	a := &ConfirmingApplier{
+		applier:  applier,
+		probes:   probes,
+		timeout:  timeout,
+		interval: interval,
+		backoff:  backoff,
+		file:     file,
+		logger:   logger,
+		now:      time.Now,
+	}
+	if file != "" {
+		good, err := readRules(file)
+		if err != nil {
+			logger.Warnw("unable to read the last known-good rules, rules cannot be rolled back until they are confirmed", "file", file, "error", err)
+		}
+		a.good = good
+	}
+	return a
+}
+
+// Apply applies the rules and rolls them back if the health probes fail.
+func (a *ConfirmingApplier) Apply(rules *controller.FirewallRules) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.rollback != nil && !rules.HasChanged(a.rollback.Rules) {
+		if a.now().Before(a.rollback.Retry) {
+			return &RollbackError{Rollback: *a.rollback}
+		}
+	} else {
+		a.rollbacks = 0
+	}
+	a.rollback = nil
+	err := a.applier.Apply(rules)
+	if err != nil {
+		return err
+	}
+	err = a.confirm()
+	if err == nil {
+		if rules.HasChanged(a.good) {
+			a.store(rules)
+		}
+		a.good = rules
+		a.rollbacks = 0
+		return nil
+	}
+
+	rerr := &RollbackError{Rollback: Rollback{Time: a.now(), Reason: err.Error(), Rules: rules}}
+	if a.good == nil {
+		rerr.Err = fmt.Errorf("no rules were confirmed before")
+		metrics.Rollbacks.WithLabelValues(rollbackFailed).Inc()
+		return rerr
+	}
+	a.logger.Errorw("new firewall rules failed health probes, restoring the last known-good rules", "reason", err)
+	rerr.Err = a.applier.Apply(a.good)
+	if rerr.Err != nil {
+		// the rules that failed the probes are still applied, so the restore is retried with the next call
+		metrics.Rollbacks.WithLabelValues(rollbackFailed).Inc()
+		return rerr
+	}
+	metrics.Rollbacks.WithLabelValues(rollbackRestored).Inc()
+	backoff := a.backoff << a.rollbacks
+	if backoff > maxRollbackBackoff || backoff < a.backoff {
+		backoff = maxRollbackBackoff
+	}
+	a.rollbacks++
+	rerr.Retry = rerr.Time.Add(backoff)
+	rollback := rerr.Rollback
+	a.rollback = &rollback
+	return rerr
+}
+
+const (
+	rollbackRestored = "restored"
+	rollbackFailed   = "failed"
+)
+
+// store writes the known-good rules to the file, failures are logged because the rules are kept in memory.
+func (a *ConfirmingApplier) store(rules *controller.FirewallRules) {
+	if a.file == "" {
+		return
+	}
+	err := writeRules(a.file, rules)
+	if err != nil {
+		a.logger.Warnw("unable to write the known-good rules, they cannot be restored after a restart", "file", a.file, "error", err)
+	}
+}
+
+// readRules reads rules that were written by writeRules, nil if the file does not exist.
+func readRules(file string) (*controller.FirewallRules, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rules := &controller.FirewallRules{}
+	err = json.Unmarshal(data, rules)
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// writeRules writes the rules to a temporary file and renames it, so the file is never partially written.
+func writeRules(file string, rules *controller.FirewallRules) error {
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".new"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// confirm runs the probes until all of them succeeded once or the timeout expired.
+func (a *ConfirmingApplier) confirm() error {
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+	pending := a.probes
+	for {
+		failed := []probe.Probe{}
+		errs := []string{}
+		for _, p := range pending {
+			pctx, pcancel := context.WithTimeout(ctx, a.interval)
+			err := p.Check(pctx)
+			pcancel()
+			if err != nil {
+				failed = append(failed, p)
+				errs = append(errs, fmt.Sprintf("%s: %s", p, err))
+			}
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		pending = failed
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s", strings.Join(errs, ", "))
+		case <-time.After(a.interval):
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package applier
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+	"github.com/metal-stack/firewall-policy-controller/pkg/metrics"
+	"github.com/metal-stack/firewall-policy-controller/pkg/probe"
+)
+
+// fakeProbe fails until it was checked the given number of times, onFailure is called for every failed check
+// if it is set.
+type fakeProbe struct {
+	failures  int
+	checks    int
+	onFailure func()
+}
+
+func (p *fakeProbe) Check(ctx context.Context) error {
+	p.checks++
+	if p.checks <= p.failures {
+		if p.onFailure != nil {
+			p.onFailure()
+		}
+		return errors.New("unreachable")
+	}
+	return nil
+}
+
+func (p *fakeProbe) String() string {
+	return "fake"
+}
+
+func TestConfirmingApplier(t *testing.T) {
+	good := &controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Verdict: controller.VerdictAccept, Comment: "good"}}}
+	bad := &controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Verdict: controller.VerdictAccept, Comment: "bad"}}}
+	p := &fakeProbe{}
+	f := &Fake{}
+	a := NewConfirmingApplier(zap.NewNop().Sugar(), f, []probe.Probe{p}, 50*time.Millisecond, time.Millisecond, time.Minute, "")
+	restored := testutil.ToFloat64(metrics.Rollbacks.WithLabelValues(rollbackRestored))
+
+	err := a.Apply(good)
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+
+	// the probe recovers within the timeout
+	p.failures, p.checks = 3, 0
+	err = a.Apply(good)
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+
+	// the probe keeps failing
+	p.failures, p.checks = 1000, 0
+	err = a.Apply(bad)
+	var rerr *RollbackError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("Apply() error = %v, want a rollback", err)
+	}
+	if rerr.Err != nil {
+		t.Errorf("rollback failed: %v", rerr.Err)
+	}
+	if rerr.Reason != "fake: unreachable" {
+		t.Errorf("got rollback reason %q, want the reason of the failed probe", rerr.Reason)
+	}
+	if got := testutil.ToFloat64(metrics.Rollbacks.WithLabelValues(rollbackRestored)) - restored; got != 1 {
+		t.Errorf("got %v restored rollbacks, want 1", got)
+	}
+	if f.Current() != good {
+		t.Errorf("current rules are %v, want the last known-good rules", f.Current())
+	}
+
+	// rolled back rules are not applied again within the backoff
+	applied := len(f.Applied())
+	err = a.Apply(&controller.FirewallRules{IngressRules: []controller.Rule{bad.IngressRules[0]}})
+	if !errors.As(err, &rerr) {
+		t.Errorf("Apply() error = %v, want the rollback", err)
+	}
+	if len(f.Applied()) != applied {
+		t.Errorf("rolled back rules were applied again")
+	}
+
+	// changed rules are applied and confirmed
+	p.failures, p.checks = 0, 0
+	err = a.Apply(&controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Verdict: controller.VerdictAccept, Comment: "fixed"}}})
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+}
+
+func TestConfirmingApplierRetriesRolledBackRules(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	good := &controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Verdict: controller.VerdictAccept, Comment: "good"}}}
+	bad := &controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Verdict: controller.VerdictAccept, Comment: "bad"}}}
+	p := &fakeProbe{}
+	f := &Fake{}
+	a := NewConfirmingApplier(zap.NewNop().Sugar(), f, []probe.Probe{p}, 10*time.Millisecond, time.Millisecond, time.Minute, "")
+	a.now = func() time.Time { return now }
+
+	err := a.Apply(good)
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	// the probe fails for reasons outside of the rules
+	p.failures, p.checks = 1000, 0
+	err = a.Apply(bad)
+	var rerr *RollbackError
+	if !errors.As(err, &rerr) || rerr.Err != nil {
+		t.Fatalf("Apply() error = %v, want a rollback", err)
+	}
+	if want := now.Add(time.Minute); !rerr.Retry.Equal(want) {
+		t.Errorf("got retry at %v, want %v", rerr.Retry, want)
+	}
+
+	// the backoff doubles with every rollback of the same rules
+	now = now.Add(time.Minute)
+	applied := len(f.Applied())
+	err = a.Apply(bad)
+	if !errors.As(err, &rerr) || rerr.Err != nil {
+		t.Fatalf("Apply() error = %v, want a rollback", err)
+	}
+	if len(f.Applied()) != applied+2 {
+		t.Errorf("got %d applies, want the rules to be applied and rolled back again", len(f.Applied())-applied)
+	}
+	if want := now.Add(2 * time.Minute); !rerr.Retry.Equal(want) {
+		t.Errorf("got retry at %v, want %v", rerr.Retry, want)
+	}
+
+	now = now.Add(2 * time.Minute)
+	p.failures, p.checks = 0, 0
+	err = a.Apply(bad)
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if f.Current() != bad {
+		t.Errorf("current rules are %v, want the rules to be confirmed after the backoff", f.Current())
+	}
+}
+
+// TestConfirmingApplierRetriesFailedRestore checks that rules are not kept as rolled back if the known-good rules
+// could not be restored.
+func TestConfirmingApplierRetriesFailedRestore(t *testing.T) {
+	good := &controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Verdict: controller.VerdictAccept, Comment: "good"}}}
+	bad := &controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Verdict: controller.VerdictAccept, Comment: "bad"}}}
+	f := &Fake{}
+	p := &fakeProbe{}
+	a := NewConfirmingApplier(zap.NewNop().Sugar(), f, []probe.Probe{p}, 10*time.Millisecond, time.Millisecond, time.Minute, "")
+
+	err := a.Apply(good)
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	p.failures, p.checks = 1000, 0
+	p.onFailure = func() { f.Err = errors.New("netlink unavailable") }
+	err = a.Apply(bad)
+	var rerr *RollbackError
+	if !errors.As(err, &rerr) || rerr.Err == nil {
+		t.Fatalf("Apply() error = %v, want a failed rollback", err)
+	}
+	if f.Current() != bad {
+		t.Fatalf("current rules are %v, want the rules that failed the probes", f.Current())
+	}
+
+	f.Err, p.onFailure = nil, nil
+	p.checks = 0
+	err = a.Apply(bad)
+	if !errors.As(err, &rerr) || rerr.Err != nil {
+		t.Fatalf("Apply() error = %v, want a rollback", err)
+	}
+	if f.Current() != good {
+		t.Errorf("current rules are %v, want the known-good rules to be restored", f.Current())
+	}
+}
+
+func TestConfirmingApplierWithoutKnownGoodRules(t *testing.T) {
+	f := &Fake{}
+	a := NewConfirmingApplier(zap.NewNop().Sugar(), f, []probe.Probe{&fakeProbe{failures: 1000}}, 10*time.Millisecond, time.Millisecond, time.Minute, "")
+	failed := testutil.ToFloat64(metrics.Rollbacks.WithLabelValues(rollbackFailed))
+	err := a.Apply(&controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Verdict: controller.VerdictAccept, Comment: "bad"}}})
+	var rerr *RollbackError
+	if !errors.As(err, &rerr) || rerr.Err == nil {
+		t.Fatalf("Apply() error = %v, want a failed rollback", err)
+	}
+	if got := testutil.ToFloat64(metrics.Rollbacks.WithLabelValues(rollbackFailed)) - failed; got != 1 {
+		t.Errorf("got %v failed rollbacks, want 1", got)
+	}
+}
+
+// TestConfirmingApplierAfterRestart checks that the known-good rules of an earlier run are restored.
+func TestConfirmingApplierAfterRestart(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "confirmed-rules.json")
+	good := &controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Verdict: controller.VerdictAccept, Comment: "good"}}}
+	p := &fakeProbe{}
+	a := NewConfirmingApplier(zap.NewNop().Sugar(), &Fake{}, []probe.Probe{p}, 10*time.Millisecond, time.Millisecond, time.Minute, file)
+	err := a.Apply(good)
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+
+	f := &Fake{}
+	p.failures, p.checks = 1000, 0
+	a = NewConfirmingApplier(zap.NewNop().Sugar(), f, []probe.Probe{p}, 10*time.Millisecond, time.Millisecond, time.Minute, file)
+	err = a.Apply(&controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Verdict: controller.VerdictAccept, Comment: "bad"}}})
+	var rerr *RollbackError
+	if !errors.As(err, &rerr) || rerr.Err != nil {
+		t.Fatalf("Apply() error = %v, want a rollback", err)
+	}
+	if f.Current().HasChanged(good) {
+		t.Errorf("current rules are %v, want the known-good rules of the earlier run", f.Current())
+	}
+}
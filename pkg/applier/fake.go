@@ -0,0 +1,44 @@
+package applier
+
+import (
+	"sync"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+)
+
+// Fake records the rules it is asked to apply instead of applying them, it is meant for tests.
+type Fake struct {
+	// Err is returned by Apply if set, failed applies are not recorded
+	Err error
+
+	mu      sync.Mutex
+	applied []*controller.FirewallRules
+}
+
+// Apply records the rules unless Err is set.
+func (f *Fake) Apply(rules *controller.FirewallRules) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	f.applied = append(f.applied, rules)
+	return nil
+}
+
+// Applied returns the rules of all successful applies in their order.
+func (f *Fake) Applied() []*controller.FirewallRules {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*controller.FirewallRules{}, f.applied...)
+}
+
+// Current returns the rules of the last successful apply, nil if nothing was applied.
+func (f *Fake) Current() *controller.FirewallRules {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.applied) == 0 {
+		return nil
+	}
+	return f.applied[len(f.applied)-1]
+}
@@ -0,0 +1,166 @@
+package applier
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+)
+
+const (
+	nftFileV4       = "/etc/nftables/firewall-policy-controller.v4"
+	nftFileV6       = "/etc/nftables/firewall-policy-controller.v6"
+	nftBin          = "/usr/sbin/nft"
+	systemctlBin    = "/bin/systemctl"
+	nftablesService = "nftables.service"
+)
+
+// FileApplier writes the rendered rules to the nftables files that are included by the nftables service and
+// reloads the service, which reloads the whole ruleset of the host.
+type FileApplier struct {
+	logger *zap.SugaredLogger
+
+	mu      sync.Mutex
+	handles map[RuleHandle]controller.Rule
+}
+
+// NewFileApplier creates a new FileApplier
+func NewFileApplier(logger *zap.SugaredLogger) *FileApplier {
+	return &FileApplier{
+		logger: logger,
+	}
+}
+
+// Apply renders and validates the nftables files of both families into temporary files, replaces the files only if
+// both are valid, either both or none of them, and reloads the nftables service. The nftables.conf of the host must include both files.
+func (a *FileApplier) Apply(rules *controller.FirewallRules) error {
+	staged := []string{}
+	defer func() {
+		for _, f := range staged {
+			_ = os.Remove(f)
+		}
+	}()
+	for _, f := range []struct {
+		file   string
+		render func() (string, error)
+	}{{nftFileV4, rules.Render}, {nftFileV6, rules.RenderV6}} {
+		tmp, err := writeNftables(f.file, f.render)
+		if tmp != "" {
+			staged = append(staged, tmp)
+		}
+		if err != nil {
+			return fmt.Errorf("error writing nftables file %s: %w", f.file, err)
+		}
+	}
+	err := replaceFiles(staged, []string{nftFileV4, nftFileV6})
+	if err != nil {
+		return &StageError{Stage: StageRender, Err: fmt.Errorf("error replacing nftables files: %w", err)}
+	}
+	staged = nil
+	out, err := exec.Command(systemctlBin, "reload", nftablesService).CombinedOutput()
+	if err != nil {
+		return &StageError{Stage: StageReload, Err: fmt.Errorf("%s could not be reloaded: %w: %s", nftablesService, err, strings.TrimSpace(string(out)))}
+	}
+	// the reloaded tables hold the rules in the order they are rendered
+	states, err := readRenderedHandles(rules)
+	if err != nil {
+		a.logger.Warnw("unable to read rule handles of the reloaded firewall tables", "error", err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.handles = rulesByHandle(states)
+	return nil
+}
+
+// Handles implements HandleRecorder.
+func (a *FileApplier) Handles() map[RuleHandle]controller.Rule {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.handles
+}
+
+// writeNftables renders the rules to a temporary file next to the given file and validates it with nft, it returns
+// the temporary file if it was written, errors carry the failed stage
+func writeNftables(file string, render func() (string, error)) (string, error) {
+	rs, err := render()
+	if err != nil {
+		return "", &StageError{Stage: StageRender, Err: fmt.Errorf("error rendering nftables rules: %w", err)}
+	}
+	tmp := file + ".new"
+	err = ioutil.WriteFile(tmp, []byte(rs), 0644)
+	if err != nil {
+		return "", &StageError{Stage: StageRender, Err: err}
+	}
+	out, err := exec.Command(nftBin, "-c", "-f", tmp).CombinedOutput()
+	if err != nil {
+		return tmp, &StageError{Stage: StageCheck, Err: fmt.Errorf("nftables file is invalid: %w: %s", err, strings.TrimSpace(string(out)))}
+	}
+	return tmp, nil
+}
+
+// replaceFiles renames the staged files to the files, either all or none of them are replaced. The files are backed
+// up by hard links before they are replaced, if a rename fails the files that were replaced already are restored.
+func replaceFiles(staged, files []string) error {
+	backups := []string{}
+	for i, file := range files {
+		backup, err := backupFile(file)
+		if err != nil {
+			return restoreFiles(files[:i], backups, fmt.Errorf("error backing up %s: %w", file, err))
+		}
+		err = os.Rename(staged[i], file)
+		if err != nil {
+			if backup != "" {
+				_ = os.Remove(backup)
+			}
+			return restoreFiles(files[:i], backups, err)
+		}
+		backups = append(backups, backup)
+	}
+	for _, b := range backups {
+		if b != "" {
+			_ = os.Remove(b)
+		}
+	}
+	return nil
+}
+
+// backupFile links the file to a backup next to it and returns the backup, it returns an empty backup if the file
+// does not exist.
+func backupFile(file string) (string, error) {
+	_, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	backup := file + ".old"
+	err = os.Remove(backup)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	return backup, os.Link(file, backup)
+}
+
+// restoreFiles restores the replaced files from their backups, files without backup did not exist and are removed.
+// It returns the cause together with the errors of the restore, backups that could not be restored are kept.
+func restoreFiles(files, backups []string, cause error) error {
+	for i, file := range files {
+		var err error
+		if backups[i] == "" {
+			err = os.Remove(file)
+		} else {
+			err = os.Rename(backups[i], file)
+		}
+		if err != nil {
+			cause = fmt.Errorf("%w, unable to restore %s: %v", cause, file, err)
+		}
+	}
+	return cause
+}
@@ -0,0 +1,66 @@
+package applier
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplaceFiles(t *testing.T) {
+	dir := t.TempDir()
+	v4, v6, v6New := filepath.Join(dir, "v4"), filepath.Join(dir, "v6"), filepath.Join(dir, "v6.new")
+	write := func(file, content string) string {
+		err := ioutil.WriteFile(file, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	read := func(file string) string {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	write(v4, "old v4")
+	write(v6, "old v6")
+
+	// the staged v6 file is missing, so the second rename fails and the replaced v4 file is restored
+	err := replaceFiles([]string{write(filepath.Join(dir, "v4.new"), "new v4"), v6New}, []string{v4, v6})
+	if err == nil {
+		t.Fatal("replaceFiles() succeeded, want the rename error")
+	}
+	if got := read(v4); got != "old v4" {
+		t.Errorf("v4 = %q, want the old file to be restored", got)
+	}
+	if got := read(v6); got != "old v6" {
+		t.Errorf("v6 = %q, want the old file to be kept", got)
+	}
+
+	// files that did not exist before are removed again
+	os.Remove(v4)
+	err = replaceFiles([]string{write(filepath.Join(dir, "v4.new"), "new v4"), v6New}, []string{v4, v6})
+	if err == nil {
+		t.Fatal("replaceFiles() succeeded, want the rename error")
+	}
+	if _, err := os.Stat(v4); !os.IsNotExist(err) {
+		t.Errorf("v4 exists, want it to be removed, error = %v", err)
+	}
+
+	err = replaceFiles([]string{write(filepath.Join(dir, "v4.new"), "new v4"), write(v6New, "new v6")}, []string{v4, v6})
+	if err != nil {
+		t.Fatalf("replaceFiles() error = %v", err)
+	}
+	if got := read(v4) + ", " + read(v6); got != "new v4, new v6" {
+		t.Errorf("files = %q, want both to be replaced", got)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("got files %v, want the backups and staged files to be removed", files)
+	}
+}
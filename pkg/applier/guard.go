@@ -0,0 +1,194 @@
+package applier
+
+import (
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+)
+
+// Confirmer decides whether blocked changes are applied anyway and reports the blocked changes.
+type Confirmer interface {
+	// Confirmed checks whether the rules with the hash were confirmed to be applied.
+	Confirmed(hash string) (bool, error)
+	// Report reports the blocked change, nil if no change is blocked anymore.
+	Report(blocked *BlockedError) error
+}
+
+// DeletionLimits limit the number of rules a change may remove, zero values do not limit.
+type DeletionLimits struct {
+	MaxCount   int
+	MaxPercent int
+}
+
+// BlockedError is returned for changes that remove more rules than allowed.
+type BlockedError struct {
+	Hash    string
+	Removed int
+	Total   int
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("change to rules %s removes %d of %d rules, which exceeds the deletion limits and needs to be confirmed", e.Hash, e.Removed, e.Total)
+}
+
+// GuardedApplier applies rules with another applier unless they remove more of the applied rules than the limits
+// allow. Blocked changes are reported and applied once they are confirmed. Rules in this sense are the dynamic
+// rules of all chains and the elements of verdict maps and sets with ports, which take the place of the rules of
+// services if they are rendered to maps.
+// Until rules were applied by this instance, changes are guarded against the rules of the live firewall tables,
+// so that the first apply after a restart, for example with an empty list of k8s entities, is guarded as well.
+// The rules of the stale policy are not guarded, they remove most rules on purpose and are applied while the api
+// server is unreachable, so the change could neither be reported nor confirmed.
+type GuardedApplier struct {
+	applier   Applier
+	limits    DeletionLimits
+	confirmer Confirmer
+	logger    *zap.SugaredLogger
+	live      func() (ruleCounts, error)
+
+	mu      sync.Mutex
+	applied *controller.FirewallRules
+	blocked bool
+}
+
+// NewGuardedApplier creates a new GuardedApplier, blocked changes are only logged if there is no confirmer
+func NewGuardedApplier(logger *zap.SugaredLogger, applier Applier, limits DeletionLimits, confirmer Confirmer) *GuardedApplier {
+	if confirmer == nil {
+		confirmer = nopConfirmer{}
+	}
+	return &GuardedApplier{
+		applier:   applier,
+		limits:    limits,
+		confirmer: confirmer,
+		logger:    logger,
+		live:      readLiveCounts,
+	}
+}
+
+// Apply applies the rules unless the change is blocked.
+func (a *GuardedApplier) Apply(rules *controller.FirewallRules) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if rules.StalePolicy {
+		return a.apply(rules)
+	}
+	removed, total, err := a.removed(rules)
+	if err != nil {
+		return err
+	}
+	if a.exceeds(removed, total) {
+		blocked := &BlockedError{Hash: rules.Hash(), Removed: removed, Total: total}
+		confirmed, err := a.confirmer.Confirmed(blocked.Hash)
+		if err != nil {
+			a.logger.Errorw("unable to check confirmation of blocked change", "error", err)
+		}
+		if !confirmed {
+			a.logger.Errorw("blocking change that removes too many rules", "hash", blocked.Hash, "removed", removed, "total", total)
+			err = a.confirmer.Report(blocked)
+			if err != nil {
+				a.logger.Errorw("unable to report blocked change", "error", err)
+			}
+			a.blocked = true
+			return blocked
+		}
+		a.logger.Infow("applying confirmed change", "hash", blocked.Hash, "removed", removed, "total", total)
+	}
+	return a.apply(rules)
+}
+
+// apply applies the rules with the wrapped applier and resolves a reported blocked change.
+func (a *GuardedApplier) apply(rules *controller.FirewallRules) error {
+	err := a.applier.Apply(rules)
+	if err != nil {
+		return err
+	}
+	a.applied = rules
+	if a.blocked {
+		a.logger.Infow("blocked change is resolved")
+		err = a.confirmer.Report(nil)
+		if err != nil {
+			a.logger.Errorw("unable to clear reported blocked change", "error", err)
+		}
+		a.blocked = false
+	}
+	return nil
+}
+
+// removed returns the number of rules the change removes and the number of rules it removes them from. The
+// first change is compared with the rules of the live firewall tables by their comments.
+func (a *GuardedApplier) removed(rules *controller.FirewallRules) (int, int, error) {
+	if a.applied != nil {
+		return removedRules(a.applied, rules.Diff(a.applied)), countRules(a.applied), nil
+	}
+	live, err := a.live()
+	if err != nil {
+		return 0, 0, &StageError{Stage: StageBlocked, Err: fmt.Errorf("unable to read the live firewall tables the first change is guarded against: %w", err)}
+	}
+	removed, total := live.removedFrom(rules)
+	return removed, total, nil
+}
+
+func (a *GuardedApplier) exceeds(removed, total int) bool {
+	if a.limits.MaxCount > 0 && removed > a.limits.MaxCount {
+		return true
+	}
+	return a.limits.MaxPercent > 0 && total > 0 && removed*100 > a.limits.MaxPercent*total
+}
+
+// countRules counts the dynamic rules and the elements that take the place of rules.
+func countRules(rules *controller.FirewallRules) int {
+	n := len(rules.IngressRules) + len(rules.EgressRules)
+	for _, c := range rules.Chains {
+		n += len(c.Rules)
+	}
+	for _, m := range rules.Maps {
+		n += len(m.Elements)
+	}
+	for _, s := range rules.Sets {
+		if s.Ports {
+			n += len(s.Elements)
+		}
+	}
+	return n
+}
+
+// removedRules counts the rules that are removed from the applied rules by the diff.
+func removedRules(applied *controller.FirewallRules, d *controller.Diff) int {
+	ports := map[string]bool{}
+	for _, s := range applied.Sets {
+		ports[string(s.Family)+" "+s.Name] = s.Ports
+	}
+	n := len(d.IngressRules.Removed) + len(d.EgressRules.Removed)
+	for _, c := range d.RemovedChains {
+		n += len(c.Rules)
+	}
+	for _, c := range d.Chains {
+		n += len(c.Removed)
+	}
+	for _, m := range d.RemovedMaps {
+		n += len(m.Elements)
+	}
+	for _, m := range d.Maps {
+		n += len(m.Removed)
+	}
+	for _, s := range d.RemovedSets {
+		if s.Ports {
+			n += len(s.Elements)
+		}
+	}
+	for _, s := range d.Sets {
+		if ports[string(s.Family)+" "+s.Name] {
+			n += len(s.Removed)
+		}
+	}
+	return n
+}
+
+// nopConfirmer confirms nothing and reports nothing, blocked changes are only logged.
+type nopConfirmer struct{}
+
+func (nopConfirmer) Confirmed(string) (bool, error) { return false, nil }
+func (nopConfirmer) Report(*BlockedError) error     { return nil }
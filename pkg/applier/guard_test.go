@@ -0,0 +1,229 @@
+package applier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+)
+
+func rulesWithCount(n int) *controller.FirewallRules {
+	rules := &controller.FirewallRules{}
+	for i := 0; i < n; i++ {
+		rules.IngressRules = append(rules.IngressRules, controller.Rule{Family: controller.FamilyIPv4, Verdict: controller.VerdictAccept, Comment: fmt.Sprint(i)})
+	}
+	return rules
+}
+
+// noLiveRules is used for guards on hosts without firewall tables.
+func noLiveRules() (ruleCounts, error) {
+	return ruleCounts{}, nil
+}
+
+func TestGuardedApplier(t *testing.T) {
+	c := testclient.NewSimpleClientset()
+	confirmer := NewConfigMapConfirmer(c, "firewall", "firewall-policy-controller")
+	f := &Fake{}
+	a := NewGuardedApplier(zap.NewNop().Sugar(), f, DeletionLimits{MaxPercent: 50}, confirmer)
+	a.live = noLiveRules
+
+	err := a.Apply(rulesWithCount(10))
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	err = a.Apply(rulesWithCount(5))
+	if err != nil {
+		t.Fatalf("Apply() of a change within the limits error = %v", err)
+	}
+
+	shrunk := rulesWithCount(2)
+	err = a.Apply(shrunk)
+	var blocked *BlockedError
+	if !errors.As(err, &blocked) {
+		t.Fatalf("Apply() error = %v, want a blocked change", err)
+	}
+	if blocked.Removed != 3 || blocked.Total != 5 || blocked.Hash != shrunk.Hash() {
+		t.Errorf("got blocked change %+v", blocked)
+	}
+	if len(f.Applied()) != 2 {
+		t.Errorf("blocked change was applied")
+	}
+	cm, err := c.CoreV1().ConfigMaps("firewall").Get(context.Background(), "firewall-policy-controller", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("blocked change was not reported: %v", err)
+	}
+	if cm.ObjectMeta.Annotations[AnnotationBlockedChange] != shrunk.Hash() {
+		t.Errorf("got annotations %v, want the hash of the blocked change", cm.ObjectMeta.Annotations)
+	}
+
+	hash, err := confirmer.Confirm()
+	if err != nil || hash != shrunk.Hash() {
+		t.Fatalf("Confirm() = %s, %v", hash, err)
+	}
+	err = a.Apply(rulesWithCount(2))
+	if err != nil {
+		t.Fatalf("Apply() of confirmed change error = %v", err)
+	}
+	cm, err = c.CoreV1().ConfigMaps("firewall").Get(context.Background(), "firewall-policy-controller", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cm.ObjectMeta.Annotations) != 0 {
+		t.Errorf("got annotations %v after the confirmed change was applied", cm.ObjectMeta.Annotations)
+	}
+	_, err = confirmer.Confirm()
+	if err == nil {
+		t.Errorf("Confirm() succeeded without blocked change")
+	}
+}
+
+func TestGuardedApplierMaxCount(t *testing.T) {
+	f := &Fake{}
+	a := NewGuardedApplier(zap.NewNop().Sugar(), f, DeletionLimits{MaxCount: 3}, nil)
+	a.live = noLiveRules
+	err := a.Apply(rulesWithCount(100))
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	err = a.Apply(rulesWithCount(97))
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	err = a.Apply(rulesWithCount(93))
+	var blocked *BlockedError
+	if !errors.As(err, &blocked) {
+		t.Fatalf("Apply() error = %v, want a blocked change", err)
+	}
+}
+
+func TestGuardedApplierFirstApply(t *testing.T) {
+	// the live tables hold the rules of the last run before the restart
+	live := countsOf(rulesWithCount(10))
+	f := &Fake{}
+	a := NewGuardedApplier(zap.NewNop().Sugar(), f, DeletionLimits{MaxPercent: 50}, nil)
+	a.live = func() (ruleCounts, error) { return live, nil }
+
+	err := a.Apply(&controller.FirewallRules{})
+	var blocked *BlockedError
+	if !errors.As(err, &blocked) {
+		t.Fatalf("Apply() error = %v, want the first change that removes all live rules to be blocked", err)
+	}
+	if blocked.Removed != 10 || blocked.Total != 10 {
+		t.Errorf("got blocked change %+v", blocked)
+	}
+	err = a.Apply(rulesWithCount(8))
+	if err != nil {
+		t.Fatalf("Apply() of a change within the limits error = %v", err)
+	}
+
+	a = NewGuardedApplier(zap.NewNop().Sugar(), f, DeletionLimits{MaxPercent: 50}, nil)
+	a.live = func() (ruleCounts, error) { return nil, errors.New("netlink unavailable") }
+	err = a.Apply(rulesWithCount(8))
+	if Stage(err) != StageBlocked {
+		t.Errorf("Apply() error = %v, want the first change to be blocked if the live rules cannot be read", err)
+	}
+	if len(f.Applied()) != 1 {
+		t.Errorf("got %d applies, want 1", len(f.Applied()))
+	}
+}
+
+// TestReadLiveCounts applies rules in a new network namespace and counts them in the live tables.
+func TestReadLiveCounts(t *testing.T) {
+	var got ruleCounts
+	inNetNS(t, func() error {
+		var err error
+		got, err = readLiveCounts()
+		if err != nil || len(got) != 0 {
+			return fmt.Errorf("got counts %v, %v without tables", got, err)
+		}
+		err = NewNetlinkApplier(zap.NewNop().Sugar()).Apply(testRules())
+		if err != nil {
+			return err
+		}
+		got, err = readLiveCounts()
+		return err
+	})
+	if want := countsOf(testRules()); !reflect.DeepEqual(got, want) {
+		t.Errorf("readLiveCounts() = %v, want %v", got, want)
+	}
+}
+
+// TestGuardedApplierStalePolicy checks that the rules of the stale policy are applied although they exceed the
+// deletion limits, because the change cannot be confirmed while the api server is unreachable.
+func TestGuardedApplierStalePolicy(t *testing.T) {
+	f := &Fake{}
+	a := NewGuardedApplier(zap.NewNop().Sugar(), f, DeletionLimits{MaxCount: 1, MaxPercent: 10}, nil)
+	a.live = noLiveRules
+
+	err := a.Apply(rulesWithCount(10))
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	closed := &controller.FirewallRules{StalePolicy: true}
+	err = a.Apply(closed)
+	if err != nil {
+		t.Fatalf("Apply() of the stale policy error = %v", err)
+	}
+	if f.Current() != closed {
+		t.Errorf("current rules are %v, want the rules of the stale policy", f.Current())
+	}
+
+	// the rules of fresh k8s entities only add rules to the rules of the stale policy
+	err = a.Apply(rulesWithCount(10))
+	if err != nil {
+		t.Fatalf("Apply() after the stale policy error = %v", err)
+	}
+	err = a.Apply(&controller.FirewallRules{})
+	var blocked *BlockedError
+	if !errors.As(err, &blocked) {
+		t.Errorf("Apply() error = %v, want changes of fresh k8s entities to be guarded", err)
+	}
+}
+
+func TestRemovedRules(t *testing.T) {
+	applied := &controller.FirewallRules{
+		Sets: []controller.Set{
+			{Family: controller.FamilyIPv4, Name: "np_1", Elements: []string{"10.0.0.1", "10.0.0.2"}},
+			{Family: controller.FamilyIPv4, Name: "services_tcp", Ports: true, Elements: []string{"10.0.0.1 . 80", "10.0.0.1 . 443"}},
+		},
+		Maps: []controller.VerdictMap{
+			{Family: controller.FamilyIPv4, Name: "services_tcp_restricted", Elements: []string{"10.0.0.2 . 443 : jump svc_1"}},
+		},
+		Chains: []controller.Chain{
+			{Family: controller.FamilyIPv4, Name: "svc_1", Rules: []controller.Rule{{Family: controller.FamilyIPv4, Verdict: controller.VerdictAccept}}},
+		},
+	}
+	rules := &controller.FirewallRules{
+		Sets: []controller.Set{
+			{Family: controller.FamilyIPv4, Name: "np_1"},
+			{Family: controller.FamilyIPv4, Name: "services_tcp", Ports: true, Elements: []string{"10.0.0.1 . 80"}},
+		},
+	}
+	if got := countRules(applied); got != 4 {
+		t.Errorf("countRules() = %d, want 4", got)
+	}
+	// the pod addresses of np_1 are not counted
+	if got := removedRules(applied, rules.Diff(applied)); got != 3 {
+		t.Errorf("removedRules() = %d, want 3", got)
+	}
+}
+
+func TestRuleComment(t *testing.T) {
+	data := []byte{0, 5, 'a', 'b', 'c', 'd', 0}
+	if got := RuleComment(data); got != "abcd" {
+		t.Errorf("RuleComment() = %q, want %q", got, "abcd")
+	}
+	if got := RuleComment([]byte{1, 1, 0, 0, 2, 'a', 0}); got != "a" {
+		t.Errorf("RuleComment() = %q, want %q", got, "a")
+	}
+	if got := RuleComment([]byte{0, 10, 'a'}); got != "" {
+		t.Errorf("RuleComment() of truncated user data = %q", got)
+	}
+}
@@ -0,0 +1,85 @@
+package applier
+
+import (
+	"github.com/google/nftables"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+)
+
+// RuleHandle identifies a rule of the firewall tables, handles are unique within the table of a family.
+type RuleHandle struct {
+	Family controller.Family
+	Handle uint64
+}
+
+// HandleRecorder is implemented by appliers that record the handles the kernel assigned to the applied rules.
+type HandleRecorder interface {
+	// Handles returns the dynamic rules of the firewall tables by their handles, nil if they are not known.
+	Handles() map[RuleHandle]controller.Rule
+}
+
+// staticHeadRules is the number of static rules before the dynamic rules of the forward chain in both appliers.
+const staticHeadRules = 4
+
+// renderedState returns the expected state of the table of a family with the rules in the order they are rendered.
+func renderedState(rules *controller.FirewallRules) *tableState {
+	state := newTableState(rules)
+	state.head = staticHeadRules
+	state.chains[chainName] = []ruleEntry{}
+	for _, r := range append(append([]controller.Rule{}, rules.IngressRules...), rules.EgressRules...) {
+		state.chains[chainName] = append(state.chains[chainName], ruleEntry{key: r.String()})
+	}
+	for _, c := range rules.Chains {
+		for _, r := range c.Rules {
+			state.chains[c.Name] = append(state.chains[c.Name], ruleEntry{key: r.String()})
+		}
+	}
+	return state
+}
+
+// readRenderedHandles reads the handles of the rules of both families that were loaded in the order they are
+// rendered.
+func readRenderedHandles(rules *controller.FirewallRules) (map[controller.Family]*tableState, error) {
+	c, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+	states := map[controller.Family]*tableState{}
+	for _, fam := range []controller.Family{controller.FamilyIPv4, controller.FamilyIPv6} {
+		state := renderedState(rules.Of(fam))
+		err = state.readHandles(c, &nftables.Table{Name: controller.TableName, Family: tableFamily(fam)}, len(tailRules()))
+		if err != nil {
+			return nil, err
+		}
+		states[fam] = state
+	}
+	return states, nil
+}
+
+// rulesByHandle returns the rules of the states by their handles.
+func rulesByHandle(states map[controller.Family]*tableState) map[RuleHandle]controller.Rule {
+	if states == nil {
+		return nil
+	}
+	r := map[RuleHandle]controller.Rule{}
+	for fam, state := range states {
+		byKey := map[string]map[string]controller.Rule{chainName: {}}
+		for _, rule := range append(append([]controller.Rule{}, state.rules.IngressRules...), state.rules.EgressRules...) {
+			byKey[chainName][rule.String()] = rule
+		}
+		for _, c := range state.rules.Chains {
+			byKey[c.Name] = map[string]controller.Rule{}
+			for _, rule := range c.Rules {
+				byKey[c.Name][rule.String()] = rule
+			}
+		}
+		for name, entries := range state.chains {
+			for _, e := range entries {
+				if rule, ok := byKey[name][e.key]; ok && e.handle != 0 {
+					r[RuleHandle{Family: fam, Handle: e.handle}] = rule
+				}
+			}
+		}
+	}
+	return r
+}
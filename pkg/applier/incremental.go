@@ -0,0 +1,272 @@
+package applier
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+)
+
+// ruleEntry is a dynamic rule of a chain with the handle the kernel assigned to it, the handle is zero until
+// it is read back after the rule was added.
+type ruleEntry struct {
+	key    string
+	handle uint64
+}
+
+// tableState is the state of the firewall table of a family that incremental updates are based on.
+type tableState struct {
+	rules *controller.FirewallRules
+	// chains holds the dynamic rules of the chains in the order of the kernel, the forward chain is held without
+	// its static rules
+	chains map[string][]ruleEntry
+	// head is the number of static rules before the dynamic rules of the forward chain
+	head int
+	// tail is the handle of the first static rule after the dynamic rules of the forward chain
+	tail uint64
+}
+
+func newTableState(rules *controller.FirewallRules) *tableState {
+	return &tableState{rules: rules, chains: map[string][]ruleEntry{}}
+}
+
+// update applies the changes between the applied rules and the rules to the firewall tables of both families
+// in a single transaction.
+func (a *NetlinkApplier) update(rules *controller.FirewallRules) error {
+	c, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("unable to open netlink connection: %w", err)
+	}
+	states := map[controller.Family]*tableState{}
+	for _, fam := range []controller.Family{controller.FamilyIPv4, controller.FamilyIPv6} {
+		t := &nftables.Table{Name: controller.TableName, Family: tableFamily(fam)}
+		b := &tableBuilder{conn: c, table: t, fam: fam, sets: map[string]*nftables.Set{}}
+		states[fam], err = b.update(a.applied[fam], rules.Of(fam))
+		if err != nil {
+			return fmt.Errorf("unable to update %s table: %w", fam, err)
+		}
+	}
+	err = c.Flush()
+	if err != nil {
+		return fmt.Errorf("unable to apply changes of firewall tables: %w", err)
+	}
+	a.readHandles(c, states)
+	return nil
+}
+
+// update adds the changes between the current state and the rules of the table and returns the expected state.
+// Rules and elements are deleted before the sets, maps and chains that they reference and added after them.
+// New rules of the forward chain are inserted after its other dynamic rules, the order of the dynamic rules does
+// not matter because they only accept packets or jump to chains that only accept packets.
+func (b *tableBuilder) update(current *tableState, rules *controller.FirewallRules) (*tableState, error) {
+	if current == nil {
+		return nil, fmt.Errorf("no state of the applied rules")
+	}
+	state := newTableState(rules)
+	state.head = current.head
+	state.tail = current.tail
+	for name, entries := range current.chains {
+		state.chains[name] = append([]ruleEntry{}, entries...)
+	}
+	sets := map[string]controller.Set{}
+	for _, s := range rules.Sets {
+		sets[s.Name] = s
+		b.sets[s.Name] = b.namedSet(s)
+	}
+	for _, m := range rules.Maps {
+		b.sets[m.Name] = b.verdictMap(m)
+	}
+	d := rules.Diff(current.rules)
+	forward := &nftables.Chain{Name: chainName, Table: b.table}
+
+	for _, r := range append(append([]controller.Rule{}, d.IngressRules.Removed...), d.EgressRules.Removed...) {
+		err := b.delRule(state, forward, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, cd := range d.Chains {
+		chain := &nftables.Chain{Name: cd.Name, Table: b.table}
+		for _, r := range cd.Removed {
+			err := b.delRule(state, chain, r)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, m := range d.Maps {
+		if len(m.Removed) == 0 {
+			continue
+		}
+		elements, err := b.mapElements(m.Removed)
+		if err != nil {
+			return nil, fmt.Errorf("map %s: %w", m.Name, err)
+		}
+		err = b.conn.SetDeleteElements(b.sets[m.Name], elements)
+		if err != nil {
+			return nil, fmt.Errorf("map %s: %w", m.Name, err)
+		}
+	}
+	for _, m := range d.RemovedMaps {
+		b.conn.DelSet(&nftables.Set{Table: b.table, Name: m.Name})
+	}
+	for _, c := range d.RemovedChains {
+		chain := &nftables.Chain{Name: c.Name, Table: b.table}
+		b.conn.FlushChain(chain)
+		b.conn.DelChain(chain)
+		delete(state.chains, c.Name)
+	}
+	for _, s := range d.Sets {
+		if len(s.Removed) == 0 {
+			continue
+		}
+		elements, err := b.setElements(sets[s.Name], s.Removed)
+		if err != nil {
+			return nil, fmt.Errorf("set %s: %w", s.Name, err)
+		}
+		err = b.conn.SetDeleteElements(b.sets[s.Name], elements)
+		if err != nil {
+			return nil, fmt.Errorf("set %s: %w", s.Name, err)
+		}
+	}
+	for _, s := range d.RemovedSets {
+		b.conn.DelSet(&nftables.Set{Table: b.table, Name: s.Name})
+	}
+
+	for _, s := range d.AddedSets {
+		err := b.addSet(s)
+		if err != nil {
+			return nil, fmt.Errorf("set %s: %w", s.Name, err)
+		}
+	}
+	for _, s := range d.Sets {
+		if len(s.Added) == 0 {
+			continue
+		}
+		elements, err := b.setElements(sets[s.Name], s.Added)
+		if err != nil {
+			return nil, fmt.Errorf("set %s: %w", s.Name, err)
+		}
+		err = b.conn.SetAddElements(b.sets[s.Name], elements)
+		if err != nil {
+			return nil, fmt.Errorf("set %s: %w", s.Name, err)
+		}
+	}
+	for _, c := range d.AddedChains {
+		chain := b.conn.AddChain(&nftables.Chain{Name: c.Name, Table: b.table})
+		state.chains[c.Name] = []ruleEntry{}
+		for _, r := range c.Rules {
+			err := b.addRule(chain, r)
+			if err != nil {
+				return nil, fmt.Errorf("chain %s: %w", c.Name, err)
+			}
+			state.chains[c.Name] = append(state.chains[c.Name], ruleEntry{key: r.String()})
+		}
+	}
+	for _, cd := range d.Chains {
+		chain := &nftables.Chain{Name: cd.Name, Table: b.table}
+		for _, r := range cd.Added {
+			err := b.addRule(chain, r)
+			if err != nil {
+				return nil, fmt.Errorf("chain %s: %w", cd.Name, err)
+			}
+			state.chains[cd.Name] = append(state.chains[cd.Name], ruleEntry{key: r.String()})
+		}
+	}
+	for _, m := range d.AddedMaps {
+		err := b.addMap(m)
+		if err != nil {
+			return nil, fmt.Errorf("map %s: %w", m.Name, err)
+		}
+	}
+	for _, m := range d.Maps {
+		if len(m.Added) == 0 {
+			continue
+		}
+		elements, err := b.mapElements(m.Added)
+		if err != nil {
+			return nil, fmt.Errorf("map %s: %w", m.Name, err)
+		}
+		err = b.conn.SetAddElements(b.sets[m.Name], elements)
+		if err != nil {
+			return nil, fmt.Errorf("map %s: %w", m.Name, err)
+		}
+	}
+	for _, r := range append(append([]controller.Rule{}, d.IngressRules.Added...), d.EgressRules.Added...) {
+		nr, err := b.rule(forward, r)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.String(), err)
+		}
+		// inserting before the first static rule at the end of the chain
+		nr.Position = state.tail
+		b.conn.InsertRule(nr)
+		state.chains[chainName] = append(state.chains[chainName], ruleEntry{key: r.String()})
+	}
+	return state, nil
+}
+
+// delRule deletes the rule by the handle of the first rule of the chain that renders the same.
+func (b *tableBuilder) delRule(state *tableState, chain *nftables.Chain, r controller.Rule) error {
+	entries := state.chains[chain.Name]
+	for i, e := range entries {
+		if e.key != r.String() || e.handle == 0 {
+			continue
+		}
+		err := b.conn.DelRule(&nftables.Rule{Table: b.table, Chain: chain, Handle: e.handle})
+		if err != nil {
+			return err
+		}
+		state.chains[chain.Name] = append(entries[:i:i], entries[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("rule %q of chain %s is not known", r.String(), chain.Name)
+}
+
+// readHandles reads the handles of the dynamic rules of all chains back from the kernel, the rules are expected in
+// the order of the states. If the rules differ from the states, the next apply replaces the tables.
+func (a *NetlinkApplier) readHandles(c *nftables.Conn, states map[controller.Family]*tableState) {
+	for fam, state := range states {
+		err := state.readHandles(c, &nftables.Table{Name: controller.TableName, Family: tableFamily(fam)}, len(tailRules()))
+		if err != nil {
+			a.logger.Warnw("unable to read rule handles, the firewall tables are replaced with the next change", "family", fam, "error", err)
+			a.applied = nil
+			a.setHandles(nil)
+			return
+		}
+	}
+	a.applied = states
+	a.setHandles(rulesByHandle(states))
+}
+
+func (a *NetlinkApplier) setHandles(h map[RuleHandle]controller.Rule) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.handles = h
+}
+
+func (s *tableState) readHandles(c *nftables.Conn, t *nftables.Table, tail int) error {
+	for name, entries := range s.chains {
+		rules, err := c.GetRules(t, &nftables.Chain{Name: name, Table: t})
+		if err != nil {
+			return fmt.Errorf("unable to list rules of chain %s: %w", name, err)
+		}
+		if name == chainName {
+			if len(rules) != s.head+len(entries)+tail {
+				return fmt.Errorf("chain %s holds %d rules, expected %d", name, len(rules), s.head+len(entries)+tail)
+			}
+			s.tail = rules[s.head+len(entries)].Handle
+			rules = rules[s.head : s.head+len(entries)]
+		}
+		if len(rules) != len(entries) {
+			return fmt.Errorf("chain %s holds %d rules, expected %d", name, len(rules), len(entries))
+		}
+		for i := range entries {
+			if entries[i].handle != 0 && entries[i].handle != rules[i].Handle {
+				return fmt.Errorf("rule %q of chain %s was changed", entries[i].key, name)
+			}
+			entries[i].handle = rules[i].Handle
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package applier
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+)
+
+// staticComments are the comments of the rules that precede and follow the dynamic rules in both appliers.
+var staticComments = map[string]bool{
+	"":                                   true,
+	"accept established connections":     true,
+	"drop packets with invalid ct state": true,
+	"drop ping floods":                   true,
+	"accept icmp":                        true,
+	"accept icmpv6":                      true,
+	"count dropped packets":              true,
+}
+
+// ruleCounts holds the number of the rules by family and comment and the number of elements of verdict maps and
+// sets with ports by family and name. Rules are identified by their comments because rules that were loaded from
+// the nftables files cannot be turned back into the rules they were rendered from.
+type ruleCounts map[string]int
+
+func ruleKey(fam controller.Family, comment string) string {
+	if len(comment) > controller.MaxCommentLength {
+		comment = comment[:controller.MaxCommentLength]
+	}
+	return fmt.Sprintf("%s rule %s", fam, comment)
+}
+
+func elementsKey(fam controller.Family, name string) string {
+	return fmt.Sprintf("%s elements %s", fam, name)
+}
+
+// countsOf counts the rules like countRules, rules without comment cannot be told apart from the static rules
+// in the live tables and are not counted.
+func countsOf(rules *controller.FirewallRules) ruleCounts {
+	r := ruleCounts{}
+	add := func(rule controller.Rule) {
+		if rule.Comment != "" {
+			r[ruleKey(rule.Family, rule.Comment)]++
+		}
+	}
+	for _, rule := range rules.IngressRules {
+		add(rule)
+	}
+	for _, rule := range rules.EgressRules {
+		add(rule)
+	}
+	for _, c := range rules.Chains {
+		for _, rule := range c.Rules {
+			add(rule)
+		}
+	}
+	for _, m := range rules.Maps {
+		r[elementsKey(m.Family, m.Name)] += len(m.Elements)
+	}
+	for _, s := range rules.Sets {
+		if s.Ports {
+			r[elementsKey(s.Family, s.Name)] += len(s.Elements)
+		}
+	}
+	return r
+}
+
+// removedFrom returns the number of the counted rules that are missing in the rules and the number of all counted
+// rules.
+func (c ruleCounts) removedFrom(rules *controller.FirewallRules) (int, int) {
+	counts := countsOf(rules)
+	removed, total := 0, 0
+	for k, n := range c {
+		total += n
+		if n > counts[k] {
+			removed += n - counts[k]
+		}
+	}
+	return removed, total
+}
+
+// readLiveCounts counts the dynamic rules and the elements of the verdict maps and sets with ports of the firewall
+// tables of both families over netlink, tables that do not exist have no rules.
+func readLiveCounts() (ruleCounts, error) {
+	c, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open netlink connection: %w", err)
+	}
+	r := ruleCounts{}
+	for _, fam := range []controller.Family{controller.FamilyIPv4, controller.FamilyIPv6} {
+		tables, err := c.ListTablesOfFamily(tableFamily(fam))
+		if err != nil {
+			return nil, fmt.Errorf("unable to list %s tables: %w", fam, err)
+		}
+		for _, t := range tables {
+			if t.Name != controller.TableName {
+				continue
+			}
+			err = countTable(c, fam, t, r)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
+
+func countTable(c *nftables.Conn, fam controller.Family, t *nftables.Table, r ruleCounts) error {
+	chains, err := c.ListChainsOfTableFamily(t.Family)
+	if err != nil {
+		return fmt.Errorf("unable to list %s chains: %w", fam, err)
+	}
+	for _, chain := range chains {
+		if chain.Table.Name != t.Name {
+			continue
+		}
+		rules, err := c.GetRules(t, chain)
+		if err != nil {
+			return fmt.Errorf("unable to read rules of %s chain %s: %w", fam, chain.Name, err)
+		}
+		for _, rule := range rules {
+			if cm := RuleComment(rule.UserData); !staticComments[cm] {
+				r[ruleKey(fam, cm)]++
+			}
+		}
+	}
+	sets, err := c.GetSets(t)
+	if err != nil {
+		return fmt.Errorf("unable to list %s sets: %w", fam, err)
+	}
+	for _, s := range sets {
+		// the elements of sets of addresses are pod addresses, which are not counted as rules
+		if s.Anonymous || (!s.IsMap && (s.KeyType == nftables.TypeIPAddr || s.KeyType == nftables.TypeIP6Addr)) {
+			continue
+		}
+		elements, err := c.GetSetElements(s)
+		if err != nil {
+			return fmt.Errorf("unable to read elements of %s set %s: %w", fam, s.Name, err)
+		}
+		for _, e := range elements {
+			if !e.IntervalEnd {
+				r[elementsKey(fam, s.Name)]++
+			}
+		}
+	}
+	return nil
+}
+
+// RuleComment returns the comment of the user data of a rule read over netlink, which is a list of type, length, value attributes.
+func RuleComment(userData []byte) string {
+	for len(userData) >= 2 {
+		typ, l := userData[0], int(userData[1])
+		if len(userData) < 2+l {
+			return ""
+		}
+		// NFTNL_UDATA_RULE_COMMENT
+		if typ == 0 {
+			v := userData[2 : 2+l]
+			if len(v) > 0 && v[len(v)-1] == 0 {
+				v = v[:len(v)-1]
+			}
+			return string(v)
+		}
+		userData = userData[2+l:]
+	}
+	return ""
+}
@@ -0,0 +1,670 @@
+package applier
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+)
+
+const (
+	chainName = "forward"
+	logPrefix = "nftables-firewall-dropped: "
+)
+
+// protocolNumbers maps the protocol names of rules to their ip protocol numbers.
+var protocolNumbers = map[string]byte{
+	"icmp":      unix.IPPROTO_ICMP,
+	"tcp":       unix.IPPROTO_TCP,
+	"udp":       unix.IPPROTO_UDP,
+	"gre":       unix.IPPROTO_GRE,
+	"esp":       unix.IPPROTO_ESP,
+	"ah":        unix.IPPROTO_AH,
+	"ipv6-icmp": unix.IPPROTO_ICMPV6,
+	"sctp":      unix.IPPROTO_SCTP,
+}
+
+// NetlinkApplier applies the rules over netlink without the nft binary. The firewall tables are replaced in a single
+// transaction the first time, the other tables of the host are not touched. Later changes are applied incrementally
+// by adding and deleting rules, sets, maps, chains and elements, so the counters of unchanged rules are kept.
+type NetlinkApplier struct {
+	logger *zap.SugaredLogger
+	// applied holds the state of the tables of each family after the last apply, nil if the tables must be replaced
+	applied map[controller.Family]*tableState
+
+	mu      sync.Mutex
+	handles map[RuleHandle]controller.Rule
+}
+
+// NewNetlinkApplier creates a new NetlinkApplier
+func NewNetlinkApplier(logger *zap.SugaredLogger) *NetlinkApplier {
+	return &NetlinkApplier{
+		logger: logger,
+	}
+}
+
+// Apply updates the firewall tables of both families atomically. If the tables cannot be updated incrementally,
+// for example because they were changed by someone else, they are replaced.
+func (a *NetlinkApplier) Apply(rules *controller.FirewallRules) error {
+	if a.applied != nil {
+		err := a.update(rules)
+		if err == nil {
+			return nil
+		}
+		a.logger.Warnw("unable to update firewall tables incrementally, replacing them", "error", err)
+	}
+	return a.replace(rules)
+}
+
+// replace replaces the firewall tables of both families atomically.
+func (a *NetlinkApplier) replace(rules *controller.FirewallRules) error {
+	a.applied = nil
+	c, err := nftables.New()
+	if err != nil {
+		return &StageError{Stage: StageReload, Err: fmt.Errorf("unable to open netlink connection: %w", err)}
+	}
+	states := map[controller.Family]*tableState{}
+	for _, fam := range []controller.Family{controller.FamilyIPv4, controller.FamilyIPv6} {
+		t := &nftables.Table{Name: controller.TableName, Family: tableFamily(fam)}
+		// the table is added first so that it can be deleted in the same transaction if it does not exist yet
+		c.AddTable(t)
+		c.DelTable(t)
+		c.AddTable(t)
+		b := &tableBuilder{conn: c, table: t, fam: fam, sets: map[string]*nftables.Set{}}
+		states[fam], err = b.build(rules.Of(fam))
+		if err != nil {
+			return &StageError{Stage: StageRender, Err: fmt.Errorf("unable to build %s table: %w", fam, err)}
+		}
+	}
+	err = c.Flush()
+	if err != nil {
+		return &StageError{Stage: StageReload, Err: fmt.Errorf("unable to apply firewall tables: %w", err)}
+	}
+	a.readHandles(c, states)
+	return nil
+}
+
+// Handles implements HandleRecorder.
+func (a *NetlinkApplier) Handles() map[RuleHandle]controller.Rule {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.handles
+}
+
+func tableFamily(fam controller.Family) nftables.TableFamily {
+	if fam == controller.FamilyIPv6 {
+		return nftables.TableFamilyIPv6
+	}
+	return nftables.TableFamilyIPv4
+}
+
+// tableBuilder adds the sets, maps, chains and rules of a family to a table within the transaction of the connection.
+type tableBuilder struct {
+	conn  *nftables.Conn
+	table *nftables.Table
+	fam   controller.Family
+	sets  map[string]*nftables.Set
+}
+
+func (b *tableBuilder) addressType() nftables.SetDatatype {
+	if b.fam == controller.FamilyIPv6 {
+		return nftables.TypeIP6Addr
+	}
+	return nftables.TypeIPAddr
+}
+
+// build adds the table with all its sets, maps, chains and rules and returns the expected state of the table.
+func (b *tableBuilder) build(rules *controller.FirewallRules) (*tableState, error) {
+	state := newTableState(rules)
+	for _, s := range rules.Sets {
+		err := b.addSet(s)
+		if err != nil {
+			return nil, fmt.Errorf("set %s: %w", s.Name, err)
+		}
+	}
+	for _, c := range rules.Chains {
+		chain := b.conn.AddChain(&nftables.Chain{Name: c.Name, Table: b.table})
+		for _, r := range c.Rules {
+			err := b.addRule(chain, r)
+			if err != nil {
+				return nil, fmt.Errorf("chain %s: %w", c.Name, err)
+			}
+			state.chains[c.Name] = append(state.chains[c.Name], ruleEntry{key: r.String()})
+		}
+	}
+	for _, m := range rules.Maps {
+		err := b.addMap(m)
+		if err != nil {
+			return nil, fmt.Errorf("map %s: %w", m.Name, err)
+		}
+	}
+
+	policy := nftables.ChainPolicyDrop
+	forward := b.conn.AddChain(&nftables.Chain{
+		Name:     chainName,
+		Table:    b.table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityRef(1),
+		Policy:   &policy,
+	})
+	head, err := b.headRules()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range head {
+		b.conn.AddRule(r.in(b.table, forward))
+	}
+	state.head = len(head)
+	state.chains[chainName] = []ruleEntry{}
+	for _, r := range append(append([]controller.Rule{}, rules.IngressRules...), rules.EgressRules...) {
+		err := b.addRule(forward, r)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.String(), err)
+		}
+		state.chains[chainName] = append(state.chains[chainName], ruleEntry{key: r.String()})
+	}
+	for _, r := range tailRules() {
+		b.conn.AddRule(r.in(b.table, forward))
+	}
+	return state, nil
+}
+
+// staticRule is a rule of the forward chain that does not depend on k8s entities.
+type staticRule struct {
+	exprs   []expr.Any
+	comment string
+}
+
+func (r staticRule) in(t *nftables.Table, c *nftables.Chain) *nftables.Rule {
+	return &nftables.Rule{Table: t, Chain: c, Exprs: r.exprs, UserData: comment(r.comment)}
+}
+
+// headRules are the rules for established connections and icmp that precede the dynamic rules.
+func (b *tableBuilder) headRules() ([]staticRule, error) {
+	rules := []staticRule{
+		{
+			exprs:   append(ctState(expr.CtStateBitESTABLISHED|expr.CtStateBitRELATED), &expr.Counter{}, &expr.Verdict{Kind: expr.VerdictAccept}),
+			comment: "accept established connections",
+		},
+		{
+			exprs:   append(ctState(expr.CtStateBitINVALID), &expr.Counter{}, &expr.Verdict{Kind: expr.VerdictDrop}),
+			comment: "drop packets with invalid ct state",
+		},
+	}
+	var icmp []expr.Any
+	var echoRequest byte
+	var types []byte
+	var typeSet nftables.SetDatatype
+	var comment string
+	if b.fam == controller.FamilyIPv6 {
+		icmp = l4proto(unix.IPPROTO_ICMPV6)
+		// echo-request and destination-unreachable, packet-too-big, time-exceeded, parameter-problem, nd-router-solicit, nd-router-advert
+		echoRequest = 128
+		types = []byte{1, 2, 3, 4, 133, 134}
+		typeSet = nftables.TypeICMP6Type
+		comment = "accept icmpv6"
+	} else {
+		icmp = []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 9, Len: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_ICMP}},
+		}
+		// echo-request and destination-unreachable, router-solicitation, router-advertisement, time-exceeded, parameter-problem
+		echoRequest = 8
+		types = []byte{3, 10, 9, 11, 12}
+		typeSet = nftables.TypeICMPType
+		comment = "accept icmp"
+	}
+	icmpType := &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1}
+	rules = append(rules, staticRule{
+		exprs: append(append([]expr.Any{}, icmp...),
+			icmpType,
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{echoRequest}},
+			&expr.Limit{Type: expr.LimitTypePkts, Rate: 10, Over: true, Unit: expr.LimitTimeSecond, Burst: 4},
+			&expr.Counter{},
+			&expr.Verdict{Kind: expr.VerdictDrop},
+		),
+		comment: "drop ping floods",
+	})
+	elements := []nftables.SetElement{}
+	for _, t := range types {
+		elements = append(elements, nftables.SetElement{Key: []byte{t}})
+	}
+	set, err := b.anonymousSet(typeSet, false, elements)
+	if err != nil {
+		return nil, err
+	}
+	rules = append(rules, staticRule{
+		exprs: append(append([]expr.Any{}, icmp...),
+			icmpType,
+			&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+			&expr.Counter{},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		),
+		comment: comment,
+	})
+	return rules, nil
+}
+
+// tailRules are the rules that count and log the dropped packets.
+func tailRules() []staticRule {
+	return []staticRule{
+		{
+			exprs:   []expr.Any{&expr.Counter{}},
+			comment: "count dropped packets",
+		},
+		{
+			exprs: []expr.Any{
+				&expr.Limit{Type: expr.LimitTypePkts, Rate: 10, Unit: expr.LimitTimeSecond, Burst: 5},
+				&expr.Counter{},
+				&expr.Log{Key: 1 << unix.NFTA_LOG_PREFIX, Data: []byte(logPrefix)},
+			},
+		},
+	}
+}
+
+func ctState(bits uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(bits), Xor: binaryutil.NativeEndian.PutUint32(0)},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
+
+func l4proto(proto byte) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+	}
+}
+
+// address loads the source or destination address into the register.
+func (b *tableBuilder) address(direction controller.Direction, register uint32) *expr.Payload {
+	offset, length := uint32(12), uint32(4)
+	if b.fam == controller.FamilyIPv6 {
+		offset, length = 8, 16
+	}
+	if direction == controller.Destination {
+		offset += length
+	}
+	return &expr.Payload{DestRegister: register, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length}
+}
+
+// destinationPort loads the destination port of tcp, udp or sctp into the register.
+func destinationPort(register uint32) *expr.Payload {
+	return &expr.Payload{DestRegister: register, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2}
+}
+
+// concatenationRegister is the 32 bit register that follows the address in register 1 in concatenations.
+func (b *tableBuilder) concatenationRegister() uint32 {
+	if b.fam == controller.FamilyIPv6 {
+		// NFT_REG_2
+		return 2
+	}
+	// NFT_REG32_01
+	return 9
+}
+
+func (b *tableBuilder) addRule(chain *nftables.Chain, r controller.Rule) error {
+	nr, err := b.rule(chain, r)
+	if err != nil {
+		return err
+	}
+	b.conn.AddRule(nr)
+	return nil
+}
+
+// rule returns the nftables rule for the rule of the chain.
+func (b *tableBuilder) rule(chain *nftables.Chain, r controller.Rule) (*nftables.Rule, error) {
+	exprs := []expr.Any{}
+	for _, a := range r.Addresses {
+		var set *nftables.Set
+		if a.Set != "" {
+			s, ok := b.sets[a.Set]
+			if !ok {
+				return nil, fmt.Errorf("unknown set %s", a.Set)
+			}
+			set = s
+		} else {
+			elements, err := addressIntervals(a.Addresses)
+			if err != nil {
+				return nil, err
+			}
+			set, err = b.anonymousSet(b.addressType(), true, elements)
+			if err != nil {
+				return nil, err
+			}
+		}
+		exprs = append(exprs,
+			b.address(a.Direction, 1),
+			&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID, Invert: a.Negated},
+		)
+	}
+	switch {
+	case r.PortSet != "" || r.PortMap != "":
+		name := r.PortSet
+		if r.PortMap != "" {
+			name = r.PortMap
+		}
+		set, ok := b.sets[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown set %s", name)
+		}
+		proto, err := protocolNumber(r.Protocol)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, l4proto(proto)...)
+		exprs = append(exprs,
+			b.address(controller.Destination, 1),
+			destinationPort(b.concatenationRegister()),
+			&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID, IsDestRegSet: r.PortMap != ""},
+		)
+	case r.Protocol != "" && len(r.Ports) > 0:
+		proto, err := protocolNumber(r.Protocol)
+		if err != nil {
+			return nil, err
+		}
+		elements, err := portIntervals(r.Ports)
+		if err != nil {
+			return nil, err
+		}
+		set, err := b.anonymousSet(nftables.TypeInetService, true, elements)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, l4proto(proto)...)
+		exprs = append(exprs,
+			destinationPort(1),
+			&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+		)
+	}
+	if len(r.Protocols) > 0 {
+		elements := []nftables.SetElement{}
+		for _, p := range r.Protocols {
+			proto, err := protocolNumber(p)
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, nftables.SetElement{Key: []byte{proto}})
+		}
+		set, err := b.anonymousSet(nftables.TypeInetProto, false, elements)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+		)
+	}
+	if r.Counter {
+		exprs = append(exprs, &expr.Counter{})
+	}
+	switch r.Verdict {
+	case controller.VerdictAccept:
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+	case "":
+	default:
+		return nil, fmt.Errorf("unsupported verdict %s", r.Verdict)
+	}
+	return &nftables.Rule{Table: b.table, Chain: chain, Exprs: exprs, UserData: comment(r.Comment)}, nil
+}
+
+func (b *tableBuilder) anonymousSet(keyType nftables.SetDatatype, interval bool, elements []nftables.SetElement) (*nftables.Set, error) {
+	s := &nftables.Set{
+		Table:     b.table,
+		Anonymous: true,
+		Constant:  true,
+		Interval:  interval,
+		KeyType:   keyType,
+	}
+	err := b.conn.AddSet(s, elements)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// namedSet returns the named set of addresses or of concatenated addresses and ports.
+func (b *tableBuilder) namedSet(s controller.Set) *nftables.Set {
+	set := &nftables.Set{Table: b.table, Name: s.Name, KeyType: b.addressType()}
+	if s.Ports {
+		set.KeyType = nftables.MustConcatSetType(b.addressType(), nftables.TypeInetService)
+		set.Concatenation = true
+	}
+	return set
+}
+
+func (b *tableBuilder) setElements(s controller.Set, values []string) ([]nftables.SetElement, error) {
+	elements := []nftables.SetElement{}
+	for _, e := range values {
+		var key []byte
+		var err error
+		if s.Ports {
+			key, err = b.addressAndPort(e)
+		} else {
+			key, err = b.ip(e)
+		}
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, nftables.SetElement{Key: key})
+	}
+	return elements, nil
+}
+
+// addSet adds a named set with its elements.
+func (b *tableBuilder) addSet(s controller.Set) error {
+	set := b.namedSet(s)
+	elements, err := b.setElements(s, s.Elements)
+	if err != nil {
+		return err
+	}
+	err = b.conn.AddSet(set, elements)
+	if err != nil {
+		return err
+	}
+	b.sets[s.Name] = set
+	return nil
+}
+
+// verdictMap returns the named verdict map of concatenated addresses and ports.
+func (b *tableBuilder) verdictMap(m controller.VerdictMap) *nftables.Set {
+	return &nftables.Set{
+		Table:         b.table,
+		Name:          m.Name,
+		IsMap:         true,
+		Concatenation: true,
+		KeyType:       nftables.MustConcatSetType(b.addressType(), nftables.TypeInetService),
+		DataType:      nftables.TypeVerdict,
+	}
+}
+
+func (b *tableBuilder) mapElements(values []string) ([]nftables.SetElement, error) {
+	elements := []nftables.SetElement{}
+	for _, e := range values {
+		parts := strings.SplitN(e, " : jump ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("unsupported map element %q", e)
+		}
+		key, err := b.addressAndPort(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, nftables.SetElement{Key: key, VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: parts[1]}})
+	}
+	return elements, nil
+}
+
+// addMap adds a named verdict map with its elements.
+func (b *tableBuilder) addMap(m controller.VerdictMap) error {
+	set := b.verdictMap(m)
+	elements, err := b.mapElements(m.Elements)
+	if err != nil {
+		return err
+	}
+	err = b.conn.AddSet(set, elements)
+	if err != nil {
+		return err
+	}
+	b.sets[m.Name] = set
+	return nil
+}
+
+func (b *tableBuilder) ip(s string) ([]byte, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	if b.fam == controller.FamilyIPv4 {
+		ip = ip.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("address %q is not an ipv4 address", s)
+		}
+	}
+	return ip, nil
+}
+
+// addressAndPort returns the key of a concatenation like "10.0.0.1 . 443", every part of the key is padded
+// to a multiple of 4 bytes.
+func (b *tableBuilder) addressAndPort(s string) ([]byte, error) {
+	parts := strings.SplitN(s, " . ", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("unsupported element %q", s)
+	}
+	ip, err := b.ip(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", parts[1])
+	}
+	key := append([]byte{}, ip...)
+	return append(key, byte(port>>8), byte(port), 0, 0), nil
+}
+
+// addressIntervals returns the elements of an interval set for the addresses and networks.
+func addressIntervals(addrs []string) ([]nftables.SetElement, error) {
+	elements := []nftables.SetElement{}
+	for _, a := range addrs {
+		var n *net.IPNet
+		if strings.Contains(a, "/") {
+			_, parsed, err := net.ParseCIDR(a)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q", a)
+			}
+			n = parsed
+		} else {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", a)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			n = &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}
+		}
+		start := []byte(n.IP)
+		end := make([]byte, len(start))
+		for i := range start {
+			end[i] = start[i] | ^n.Mask[i]
+		}
+		elements = append(elements, interval(start, end)...)
+	}
+	return withZeroEnd(elements, len(addrs) > 0), nil
+}
+
+// portIntervals returns the elements of an interval set for the ports and port ranges.
+func portIntervals(ports []string) ([]nftables.SetElement, error) {
+	elements := []nftables.SetElement{}
+	for _, p := range ports {
+		bounds := strings.SplitN(p, "-", 2)
+		from, err := strconv.ParseUint(bounds[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		to := from
+		if len(bounds) == 2 {
+			to, err = strconv.ParseUint(bounds[1], 10, 16)
+			if err != nil || to < from {
+				return nil, fmt.Errorf("invalid port range %q", p)
+			}
+		}
+		start := make([]byte, 2)
+		end := make([]byte, 2)
+		binary.BigEndian.PutUint16(start, uint16(from))
+		binary.BigEndian.PutUint16(end, uint16(to))
+		elements = append(elements, interval(start, end)...)
+	}
+	return withZeroEnd(elements, len(ports) > 0), nil
+}
+
+// interval returns the elements of an interval from start to end including the end, the interval end element
+// holds the value following the end and is left out if the interval reaches the maximum value.
+func interval(start, end []byte) []nftables.SetElement {
+	elements := []nftables.SetElement{{Key: start}}
+	next := append([]byte{}, end...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return append(elements, nftables.SetElement{Key: next, IntervalEnd: true})
+		}
+	}
+	return elements
+}
+
+// withZeroEnd prepends an interval end at zero like nft does, unless an interval starts at zero.
+func withZeroEnd(elements []nftables.SetElement, ok bool) []nftables.SetElement {
+	if !ok {
+		return elements
+	}
+	for _, e := range elements {
+		if !e.IntervalEnd && isZero(e.Key) {
+			return elements
+		}
+	}
+	zero := make([]byte, len(elements[0].Key))
+	return append([]nftables.SetElement{{Key: zero, IntervalEnd: true}}, elements...)
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func protocolNumber(name string) (byte, error) {
+	p, ok := protocolNumbers[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported protocol %s", name)
+	}
+	return p, nil
+}
+
+// comment encodes the comment of a rule as user data like nft does.
+func comment(c string) []byte {
+	if c == "" {
+		return nil
+	}
+	if len(c) > controller.MaxCommentLength {
+		c = c[:controller.MaxCommentLength]
+	}
+	// NFTNL_UDATA_RULE_COMMENT with the length of the comment including the terminating null byte
+	data := []byte{0, byte(len(c) + 1)}
+	data = append(data, c...)
+	return append(data, 0)
+}
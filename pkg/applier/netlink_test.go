@@ -0,0 +1,381 @@
+package applier
+
+import (
+	"net"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/sys/unix"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+)
+
+func TestPortIntervals(t *testing.T) {
+	tests := []struct {
+		name  string
+		ports []string
+		want  []nftables.SetElement
+	}{
+		{
+			name:  "single port",
+			ports: []string{"443"},
+			want: []nftables.SetElement{
+				{Key: []byte{0, 0}, IntervalEnd: true},
+				{Key: []byte{1, 187}},
+				{Key: []byte{1, 188}, IntervalEnd: true},
+			},
+		},
+		{
+			name:  "range up to the last port",
+			ports: []string{"30000-65535"},
+			want: []nftables.SetElement{
+				{Key: []byte{0, 0}, IntervalEnd: true},
+				{Key: []byte{117, 48}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := portIntervals(tt.ports)
+			if err != nil {
+				t.Fatalf("portIntervals() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("portIntervals() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddressIntervals(t *testing.T) {
+	got, err := addressIntervals([]string{"0.0.0.0/0"})
+	if err != nil {
+		t.Fatalf("addressIntervals() error = %v", err)
+	}
+	want := []nftables.SetElement{{Key: []byte{0, 0, 0, 0}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("addressIntervals() = %v, want %v", got, want)
+	}
+	got, err = addressIntervals([]string{"10.0.0.0/8", "192.168.0.1"})
+	if err != nil {
+		t.Fatalf("addressIntervals() error = %v", err)
+	}
+	want = []nftables.SetElement{
+		{Key: []byte{0, 0, 0, 0}, IntervalEnd: true},
+		{Key: []byte{10, 0, 0, 0}},
+		{Key: []byte{11, 0, 0, 0}, IntervalEnd: true},
+		{Key: []byte{192, 168, 0, 1}},
+		{Key: []byte{192, 168, 0, 2}, IntervalEnd: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("addressIntervals() = %v, want %v", got, want)
+	}
+}
+
+// inNetNS runs the function in a new network namespace and skips the test if network namespaces cannot be created.
+// The function must not call t.Fatal because it runs in another goroutine.
+func inNetNS(t *testing.T, f func() error) {
+	unshared := make(chan error, 1)
+	done := make(chan error, 1)
+	go func() {
+		// the thread is left locked so that it is discarded with its network namespace when the goroutine ends
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			unshared <- err
+			return
+		}
+		unshared <- nil
+		done <- f()
+	}()
+	if err := <-unshared; err != nil {
+		t.Skipf("unable to create network namespace: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listing is the part of the ruleset of a network namespace that the tests check.
+type listing struct {
+	tables    []*nftables.Table
+	chains    []*nftables.Chain
+	forwardV4 []*nftables.Rule
+	forwardV6 []*nftables.Rule
+	elements  map[string][]nftables.SetElement
+}
+
+func list(sets ...string) (*listing, error) {
+	c, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+	l := &listing{elements: map[string][]nftables.SetElement{}}
+	v4 := &nftables.Table{Name: controller.TableName, Family: nftables.TableFamilyIPv4}
+	v6 := &nftables.Table{Name: controller.TableName, Family: nftables.TableFamilyIPv6}
+	l.tables, err = c.ListTables()
+	if err != nil {
+		return nil, err
+	}
+	l.chains, err = c.ListChains()
+	if err != nil {
+		return nil, err
+	}
+	l.forwardV4, err = c.GetRules(v4, &nftables.Chain{Name: chainName, Table: v4})
+	if err != nil {
+		return nil, err
+	}
+	l.forwardV6, err = c.GetRules(v6, &nftables.Chain{Name: chainName, Table: v6})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range sets {
+		set, err := c.GetSetByName(v4, name)
+		if err != nil {
+			return nil, err
+		}
+		l.elements[name], err = c.GetSetElements(set)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func handles(rules []*nftables.Rule) []uint64 {
+	r := []uint64{}
+	for _, rule := range rules {
+		r = append(r, rule.Handle)
+	}
+	return r
+}
+
+func testRules() *controller.FirewallRules {
+	return &controller.FirewallRules{
+		IngressRules: []controller.Rule{
+			{
+				Family:    controller.FamilyIPv4,
+				Addresses: []controller.AddressMatch{{Direction: controller.Source, Addresses: []string{"10.0.0.0/8"}}, {Direction: controller.Destination, Set: "np_1"}},
+				Protocol:  "tcp",
+				Ports:     []string{"80", "8000-8080"},
+				Counter:   true,
+				Verdict:   controller.VerdictAccept,
+				Comment:   "accept traffic for k8s network policy default/np",
+			},
+			{
+				Family:    controller.FamilyIPv6,
+				Addresses: []controller.AddressMatch{{Direction: controller.Destination, Addresses: []string{"fd00::1"}}},
+				Protocols: []string{"udp", "gre"},
+				Counter:   true,
+				Verdict:   controller.VerdictAccept,
+			},
+			{
+				Family:   controller.FamilyIPv4,
+				Protocol: "tcp",
+				PortMap:  "services_tcp_restricted",
+				Counter:  true,
+			},
+		},
+		Sets: []controller.Set{
+			{Family: controller.FamilyIPv4, Name: "np_1", Elements: []string{"10.1.0.1", "10.1.0.2"}},
+			{Family: controller.FamilyIPv4, Name: "services_tcp", Ports: true, Elements: []string{"10.2.0.1 . 443"}},
+		},
+		Maps: []controller.VerdictMap{
+			{Family: controller.FamilyIPv4, Name: "services_tcp_restricted", Elements: []string{"10.2.0.2 . 443 : jump svc_1"}},
+		},
+		Chains: []controller.Chain{
+			{Family: controller.FamilyIPv4, Name: "svc_1", Rules: []controller.Rule{{
+				Family:    controller.FamilyIPv4,
+				Addresses: []controller.AddressMatch{{Direction: controller.Source, Addresses: []string{"192.168.0.0/16"}}},
+				Counter:   true,
+				Verdict:   controller.VerdictAccept,
+			}}},
+		},
+	}
+}
+
+// TestNetlinkApply applies rules in a new network namespace and reads the tables back.
+// TestCommentLength checks that comments of the maximum length are stored like nft stores them, so the live tables
+// can be compared regardless of the applier that loaded them.
+func TestCommentLength(t *testing.T) {
+	long := strings.Repeat("a", controller.MaxCommentLength)
+	if got := RuleComment(comment(long)); got != long {
+		t.Errorf("RuleComment() = %q, want the comment of maximum length", got)
+	}
+	if got := RuleComment(comment(long + "b")); got != long {
+		t.Errorf("RuleComment() = %q, want the comment truncated to the maximum length", got)
+	}
+	if got, want := ruleKey(controller.FamilyIPv4, long+"b"), ruleKey(controller.FamilyIPv4, long); got != want {
+		t.Errorf("ruleKey() = %q, want %q", got, want)
+	}
+}
+
+func TestNetlinkApply(t *testing.T) {
+	var l *listing
+	var recorded, rendered map[RuleHandle]controller.Rule
+	inNetNS(t, func() error {
+		a := NewNetlinkApplier(zap.NewNop().Sugar())
+		err := a.Apply(testRules())
+		if err != nil {
+			return err
+		}
+		l, err = list()
+		if err != nil {
+			return err
+		}
+		recorded = a.Handles()
+		states, err := readRenderedHandles(testRules())
+		rendered = rulesByHandle(states)
+		return err
+	})
+	if len(l.tables) != 2 {
+		t.Errorf("got %d tables, want 2", len(l.tables))
+	}
+	if len(l.chains) != 3 {
+		t.Errorf("got %d chains, want 3", len(l.chains))
+	}
+	// four static rules at the start, the dynamic rules and two static rules at the end
+	if len(l.forwardV4) != 4+2+2 {
+		t.Fatalf("got %d ipv4 rules, want %d", len(l.forwardV4), 4+2+2)
+	}
+	if len(l.forwardV6) != 4+1+2 {
+		t.Errorf("got %d ipv6 rules, want %d", len(l.forwardV6), 4+1+2)
+	}
+	if got, want := l.forwardV4[4].UserData, comment("accept traffic for k8s network policy default/np"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got user data %q, want %q", got, want)
+	}
+	if got, want := recorded[RuleHandle{Family: controller.FamilyIPv4, Handle: l.forwardV4[4].Handle}], testRules().IngressRules[0]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got rule %v for handle %d, want %v", got, l.forwardV4[4].Handle, want)
+	}
+	// four dynamic rules of the forward chains and the rule of the service chain
+	if len(recorded) != 4 {
+		t.Errorf("got %d rules by handle, want 4", len(recorded))
+	}
+	if !reflect.DeepEqual(recorded, rendered) {
+		t.Errorf("got rules %v by the handles of the rendered rules, want %v", rendered, recorded)
+	}
+}
+
+// TestNetlinkApplyIncremental checks that changes are applied without replacing the rules that did not change.
+func TestNetlinkApplyIncremental(t *testing.T) {
+	changed := testRules()
+	added := controller.Rule{
+		Family:    controller.FamilyIPv4,
+		Addresses: []controller.AddressMatch{{Direction: controller.Destination, Addresses: []string{"10.3.0.1"}}},
+		Protocol:  "udp",
+		Ports:     []string{"53"},
+		Counter:   true,
+		Verdict:   controller.VerdictAccept,
+	}
+	changed.IngressRules = append(changed.IngressRules, added)
+	changed.Sets[0].Elements = []string{"10.1.0.2", "10.1.0.3"}
+	changed.Maps[0].Elements = []string{"10.2.0.2 . 443 : jump svc_2"}
+	changed.Chains[0].Name = "svc_2"
+
+	logs, observed := observer.New(zap.WarnLevel)
+	var before, after *listing
+	var recorded map[RuleHandle]controller.Rule
+	inNetNS(t, func() error {
+		a := NewNetlinkApplier(zap.New(logs).Sugar())
+		err := a.Apply(testRules())
+		if err != nil {
+			return err
+		}
+		before, err = list()
+		if err != nil {
+			return err
+		}
+		err = a.Apply(changed)
+		if err != nil {
+			return err
+		}
+		after, err = list("np_1")
+		recorded = a.Handles()
+		return err
+	})
+	if observed.Len() > 0 {
+		t.Fatalf("tables were replaced: %v", observed.All()[0].ContextMap())
+	}
+	if len(after.forwardV4) != 4+3+2 {
+		t.Fatalf("got %d ipv4 rules, want %d", len(after.forwardV4), 4+3+2)
+	}
+	if got, want := handles(after.forwardV4[:6]), handles(before.forwardV4[:6]); !reflect.DeepEqual(got, want) {
+		t.Errorf("got handles %v of unchanged rules, want %v", got, want)
+	}
+	if got, want := handles(after.forwardV6), handles(before.forwardV6); !reflect.DeepEqual(got, want) {
+		t.Errorf("got ipv6 handles %v, want %v", got, want)
+	}
+	if got, want := handles(after.forwardV4[7:]), handles(before.forwardV4[6:]); !reflect.DeepEqual(got, want) {
+		t.Errorf("got handles %v of the static rules at the end, want %v", got, want)
+	}
+	// the added rule is inserted before the static rules at the end
+	if got := recorded[RuleHandle{Family: controller.FamilyIPv4, Handle: after.forwardV4[6].Handle}]; !reflect.DeepEqual(got, added) {
+		t.Errorf("got rule %v for the handle of the added rule, want %v", got, added)
+	}
+	elements := []string{}
+	for _, e := range after.elements["np_1"] {
+		elements = append(elements, net.IP(e.Key).String())
+	}
+	sort.Strings(elements)
+	if want := []string{"10.1.0.2", "10.1.0.3"}; !reflect.DeepEqual(elements, want) {
+		t.Errorf("got set elements %v, want %v", elements, want)
+	}
+	chains := []string{}
+	for _, c := range after.chains {
+		chains = append(chains, c.Name)
+	}
+	sort.Strings(chains)
+	if want := []string{"forward", "forward", "svc_2"}; !reflect.DeepEqual(chains, want) {
+		t.Errorf("got chains %v, want %v", chains, want)
+	}
+}
+
+// TestNetlinkApplyReplacesChangedTables checks that the tables are replaced if they were changed by someone else.
+func TestNetlinkApplyReplacesChangedTables(t *testing.T) {
+	changed := testRules()
+	changed.IngressRules = changed.IngressRules[1:]
+
+	logs, observed := observer.New(zap.WarnLevel)
+	var after *listing
+	inNetNS(t, func() error {
+		a := NewNetlinkApplier(zap.New(logs).Sugar())
+		err := a.Apply(testRules())
+		if err != nil {
+			return err
+		}
+		l, err := list()
+		if err != nil {
+			return err
+		}
+		c, err := nftables.New()
+		if err != nil {
+			return err
+		}
+		// the rule that is removed by the change is deleted by someone else
+		err = c.DelRule(l.forwardV4[4])
+		if err != nil {
+			return err
+		}
+		err = c.Flush()
+		if err != nil {
+			return err
+		}
+		err = a.Apply(changed)
+		if err != nil {
+			return err
+		}
+		after, err = list()
+		return err
+	})
+	if observed.Len() != 1 {
+		t.Errorf("got %d warnings, want the warning about replacing the tables", observed.Len())
+	}
+	if len(after.forwardV4) != 4+1+2 {
+		t.Errorf("got %d ipv4 rules, want %d", len(after.forwardV4), 4+1+2)
+	}
+}
@@ -1,27 +1,207 @@
 package controller
 
 import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
 	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/metrics"
 )
 
-// FirewallController watches for changes of the k8s entities services and networkpolicies and constructs nftable rules for them.
+// FirewallController constructs nftable rules for the k8s entities services and networkpolicies. The entities
+// are read from the caches of shared informers, which watch for their changes.
 type FirewallController struct {
-	c      k8s.Interface
-	logger *zap.SugaredLogger
+	logger   *zap.SugaredLogger
+	config   Config
+	resolver *hostResolver
+
+	informers       map[string]cache.SharedIndexInformer
+	networkPolicies networkinglisters.NetworkPolicyLister
+	services        corelisters.ServiceLister
+	pods            corelisters.PodLister
+	namespaces      corelisters.NamespaceLister
+	nodes           corelisters.NodeLister
+
+	now      func() time.Time
+	mu       sync.Mutex
+	failures map[string]*watchFailure
+}
+
+// watchFailure records the failures of the watch of an informer since its last successful list or watch.
+type watchFailure struct {
+	since   time.Time
+	err     error
+	version string
+}
+
+// StaleError is returned if the caches of the informers are not kept up to date because their watches fail.
+type StaleError struct {
+	Resource string
+	// Since is the time of the first failure after the last successful list or watch of the resource
+	Since time.Time
+	Err   error
+}
+
+func (e *StaleError) Error() string {
+	return fmt.Sprintf("watch of %s is failing since %s: %v", e.Resource, e.Since.Format(time.RFC3339), e.Err)
+}
+
+func (e *StaleError) Unwrap() error {
+	return e.Err
+}
+
+// Config holds the settings that control which k8s entities are turned into firewall rules.
+type Config struct {
+	// AllPolicyNamespaces enforces the network policies of all namespaces, it must not be combined with
+	// PolicyNamespaces and PolicyNamespaceSelector. Without any of them no network policies are enforced, the
+	// firewall-policy-controller command sets AllPolicyNamespaces with a warning in that case.
+	AllPolicyNamespaces bool
+	// PolicyNamespaces are the namespaces whose network policies are enforced.
+	PolicyNamespaces []string
+	// PolicyNamespaceSelector selects the namespaces by their labels whose network policies are enforced.
+	PolicyNamespaceSelector labels.Selector
+	// Resolver resolves the host names of load balancers, the default resolver is used if not set.
+	Resolver Resolver
+	// ResolveInterval is the interval after which host names are resolved again.
+	ResolveInterval time.Duration
+	// RenderMode selects how the rules for services are rendered, RenderModeRules is used if not set.
+	RenderMode RenderMode
+	// ObjectCounters keeps the counting rules of different k8s entities apart, so that their counters can be
+	// attributed to a single entity. The rules of different entities are not merged and services rendered to
+	// maps are accepted by a chain per service.
+	ObjectCounters bool
 }
 
-// NewFirewallController creates a new FirewallController
-func NewFirewallController(client k8s.Interface, logger *zap.SugaredLogger) *FirewallController {
-	return &FirewallController{
-		c:      client,
-		logger: logger,
+// RenderMode is the way the rules for services are rendered.
+type RenderMode string
+
+const (
+	// RenderModeRules renders separate rules for every service.
+	RenderModeRules RenderMode = "rules"
+	// RenderModeMaps aggregates the addresses and ports of all services into named sets and verdict maps,
+	// which keeps the number of rules constant for large numbers of services.
+	RenderModeMaps RenderMode = "maps"
+)
+
+// NewFirewallController creates a new FirewallController, which registers the informers it needs with the
+// factory. The factory must be started and its caches synced before rules are assembled.
+func NewFirewallController(factory informers.SharedInformerFactory, logger *zap.SugaredLogger, config Config) *FirewallController {
+	np := factory.Networking().V1().NetworkPolicies()
+	svc := factory.Core().V1().Services()
+	pod := factory.Core().V1().Pods()
+	ns := factory.Core().V1().Namespaces()
+	node := factory.Core().V1().Nodes()
+	f := &FirewallController{
+		logger:   logger,
+		config:   config,
+		resolver: newHostResolver(config.Resolver, config.ResolveInterval, logger),
+		informers: map[string]cache.SharedIndexInformer{
+			"networkpolicies": np.Informer(),
+			"services":        svc.Informer(),
+			"pods":            pod.Informer(),
+			"namespaces":      ns.Informer(),
+			"nodes":           node.Informer(),
+		},
+		networkPolicies: np.Lister(),
+		services:        svc.Lister(),
+		pods:            pod.Lister(),
+		namespaces:      ns.Lister(),
+		nodes:           node.Lister(),
+		now:             time.Now,
+		failures:        map[string]*watchFailure{},
+	}
+	for resource, informer := range f.informers {
+		resource := resource
+		err := informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+			logger.Errorw("watch failed, restarting it", "resource", resource, "error", err)
+			metrics.WatchRestarts.WithLabelValues(resource).Inc()
+			f.watchFailed(resource, err)
+		})
+		if err != nil {
+			logger.Warnw("unable to set watch error handler", "resource", resource, "error", err)
+		}
+	}
+	return f
+}
+
+// AddEventHandler adds the handler to the informers of all entities that serve as input for the rules.
+func (f *FirewallController) AddEventHandler(handler cache.ResourceEventHandler) {
+	for _, informer := range f.informers {
+		informer.AddEventHandler(handler)
 	}
 }
 
-// FetchAndAssemble fetches resources from k8s and assembles firewall rules for them
+// OnHostsResolved sets the function that is called when the addresses of the host names of load balancers changed,
+// which are resolved in the background.
+func (f *FirewallController) OnHostsResolved(changed func()) {
+	f.resolver.onChange(changed)
+}
+
+// HasSynced returns whether the caches of all informers are synced.
+func (f *FirewallController) HasSynced() bool {
+	for _, informer := range f.informers {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// watchFailed records the failure of the watch of the resource. The reflector of the informer lists the
+// resource again after a failure, which updates the resource version of the informer once it succeeds.
+func (f *FirewallController) watchFailed(resource string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	version := f.informers[resource].LastSyncResourceVersion()
+	w, ok := f.failures[resource]
+	if !ok || w.version != version {
+		w = &watchFailure{since: f.now()}
+		f.failures[resource] = w
+	}
+	w.err = err
+	w.version = version
+}
+
+// stale returns a StaleError for the resource whose watch fails the longest, nil if the caches of all
+// informers are up to date.
+func (f *FirewallController) stale() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var stale *StaleError
+	for resource, w := range f.failures {
+		if f.informers[resource].LastSyncResourceVersion() != w.version {
+			// listed or watched successfully since the failure
+			delete(f.failures, resource)
+			continue
+		}
+		if stale == nil || w.since.Before(stale.Since) {
+			stale = &StaleError{Resource: resource, Since: w.since, Err: w.err}
+		}
+	}
+	if stale == nil {
+		return nil
+	}
+	return stale
+}
+
+// FetchAndAssemble fetches resources from the informer caches and assembles firewall rules for them. It returns
+// a StaleError instead if the caches are not kept up to date because watches fail.
 func (f *FirewallController) FetchAndAssemble() (*FirewallRules, error) {
+	err := f.stale()
+	if err != nil {
+		return nil, err
+	}
 	r, err := f.fetchResources()
 	if err != nil {
 		return nil, err
@@ -34,16 +214,77 @@ func (f *FirewallController) FetchAndAssemble() (*FirewallRules, error) {
 }
 
 func (f *FirewallController) fetchResources() (*FirewallResources, error) {
-	npl, err := f.c.NetworkingV1().NetworkPolicies(metav1.NamespaceAll).List(metav1.ListOptions{})
+	nps, err := f.networkPolicies.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	svcs, err := f.services.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	pods, err := f.pods.List(labels.Everything())
 	if err != nil {
 		return nil, err
 	}
-	svcs, err := f.c.CoreV1().Services(metav1.NamespaceAll).List(metav1.ListOptions{})
+	nss, err := f.namespaces.List(labels.Everything())
 	if err != nil {
 		return nil, err
 	}
+	nodes, err := f.nodes.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	// the caches are unordered, the entities are sorted like the api server lists them to get stable rules
+	npl := &networkingv1.NetworkPolicyList{}
+	for _, np := range nps {
+		npl.Items = append(npl.Items, *np)
+	}
+	sort.Slice(npl.Items, func(i, j int) bool { return less(npl.Items[i].ObjectMeta, npl.Items[j].ObjectMeta) })
+	svcl := &corev1.ServiceList{}
+	for _, svc := range svcs {
+		svcl.Items = append(svcl.Items, *svc)
+	}
+	sort.Slice(svcl.Items, func(i, j int) bool { return less(svcl.Items[i].ObjectMeta, svcl.Items[j].ObjectMeta) })
+	podl := &corev1.PodList{}
+	for _, pod := range pods {
+		podl.Items = append(podl.Items, *pod)
+	}
+	sort.Slice(podl.Items, func(i, j int) bool { return less(podl.Items[i].ObjectMeta, podl.Items[j].ObjectMeta) })
+	nsl := &corev1.NamespaceList{}
+	for _, ns := range nss {
+		nsl.Items = append(nsl.Items, *ns)
+	}
+	sort.Slice(nsl.Items, func(i, j int) bool { return less(nsl.Items[i].ObjectMeta, nsl.Items[j].ObjectMeta) })
+	nodel := &corev1.NodeList{}
+	for _, node := range nodes {
+		nodel.Items = append(nodel.Items, *node)
+	}
+	sort.Slice(nodel.Items, func(i, j int) bool { return less(nodel.Items[i].ObjectMeta, nodel.Items[j].ObjectMeta) })
+
+	hosts := []string{}
+	for _, svc := range svcl.Items {
+		for _, e := range svc.Status.LoadBalancer.Ingress {
+			if e.Hostname != "" {
+				hosts = append(hosts, e.Hostname)
+			}
+		}
+	}
 	return &FirewallResources{
 		NetworkPolicyList: npl,
-		ServiceList:       svcs,
+		ServiceList:       svcl,
+		PodList:           podl,
+		NamespaceList:     nsl,
+		NodeList:          nodel,
+		HostIPs:           f.resolver.resolve(hosts),
+		logger:            f.logger,
+		config:            f.config,
 	}, nil
 }
+
+// less orders entities by namespace and name.
+func less(a, b metav1.ObjectMeta) bool {
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	return a.Name < b.Name
+}
@@ -0,0 +1,191 @@
+package controller
+
+// RulesDiff holds the rules that were added and removed. Rules are compared by their family and their rendered form,
+// so rules that only differ in their origins are unchanged.
+type RulesDiff struct {
+	Added   []Rule
+	Removed []Rule
+}
+
+// ElementsDiff holds the elements that were added to and removed from a set or verdict map that exists before and
+// after the change.
+type ElementsDiff struct {
+	Family  Family
+	Name    string
+	Added   []string
+	Removed []string
+}
+
+// ChainDiff holds the rules that were added to and removed from a chain that exists before and after the change.
+type ChainDiff struct {
+	Family Family
+	Name   string
+	RulesDiff
+}
+
+// Diff holds the changes between two versions of firewall rules. Sets, maps and chains that exist in both versions
+// are listed with the changes of their elements and rules, sets whose type changed are removed and added again.
+type Diff struct {
+	IngressRules RulesDiff
+	EgressRules  RulesDiff
+
+	AddedSets   []Set
+	RemovedSets []Set
+	Sets        []ElementsDiff
+
+	AddedMaps   []VerdictMap
+	RemovedMaps []VerdictMap
+	Maps        []ElementsDiff
+
+	AddedChains   []Chain
+	RemovedChains []Chain
+	Chains        []ChainDiff
+}
+
+// Diff returns the changes from the old rules to the rules, everything is added if there are no old rules.
+func (r *FirewallRules) Diff(oldRules *FirewallRules) *Diff {
+	if oldRules == nil {
+		oldRules = &FirewallRules{}
+	}
+	d := &Diff{
+		IngressRules: diffRules(oldRules.IngressRules, r.IngressRules),
+		EgressRules:  diffRules(oldRules.EgressRules, r.EgressRules),
+	}
+
+	oldSets := map[string]Set{}
+	for _, s := range oldRules.Sets {
+		oldSets[string(s.Family)+" "+s.Name] = s
+	}
+	newSets := map[string]bool{}
+	for _, s := range r.Sets {
+		newSets[string(s.Family)+" "+s.Name] = true
+		old, ok := oldSets[string(s.Family)+" "+s.Name]
+		switch {
+		case !ok:
+			d.AddedSets = append(d.AddedSets, s)
+		case old.Ports != s.Ports:
+			d.RemovedSets = append(d.RemovedSets, old)
+			d.AddedSets = append(d.AddedSets, s)
+		default:
+			if e := diffElements(s.Family, s.Name, old.Elements, s.Elements); e != nil {
+				d.Sets = append(d.Sets, *e)
+			}
+		}
+	}
+	for _, s := range oldRules.Sets {
+		if !newSets[string(s.Family)+" "+s.Name] {
+			d.RemovedSets = append(d.RemovedSets, s)
+		}
+	}
+
+	oldMaps := map[string]VerdictMap{}
+	for _, m := range oldRules.Maps {
+		oldMaps[string(m.Family)+" "+m.Name] = m
+	}
+	newMaps := map[string]bool{}
+	for _, m := range r.Maps {
+		newMaps[string(m.Family)+" "+m.Name] = true
+		old, ok := oldMaps[string(m.Family)+" "+m.Name]
+		if !ok {
+			d.AddedMaps = append(d.AddedMaps, m)
+			continue
+		}
+		if e := diffElements(m.Family, m.Name, old.Elements, m.Elements); e != nil {
+			d.Maps = append(d.Maps, *e)
+		}
+	}
+	for _, m := range oldRules.Maps {
+		if !newMaps[string(m.Family)+" "+m.Name] {
+			d.RemovedMaps = append(d.RemovedMaps, m)
+		}
+	}
+
+	oldChains := map[string]Chain{}
+	for _, c := range oldRules.Chains {
+		oldChains[string(c.Family)+" "+c.Name] = c
+	}
+	newChains := map[string]bool{}
+	for _, c := range r.Chains {
+		newChains[string(c.Family)+" "+c.Name] = true
+		old, ok := oldChains[string(c.Family)+" "+c.Name]
+		if !ok {
+			d.AddedChains = append(d.AddedChains, c)
+			continue
+		}
+		rd := diffRules(old.Rules, c.Rules)
+		if len(rd.Added) > 0 || len(rd.Removed) > 0 {
+			d.Chains = append(d.Chains, ChainDiff{Family: c.Family, Name: c.Name, RulesDiff: rd})
+		}
+	}
+	for _, c := range oldRules.Chains {
+		if !newChains[string(c.Family)+" "+c.Name] {
+			d.RemovedChains = append(d.RemovedChains, c)
+		}
+	}
+	return d
+}
+
+// Empty checks whether the diff holds no changes.
+func (d *Diff) Empty() bool {
+	return len(d.IngressRules.Added) == 0 && len(d.IngressRules.Removed) == 0 &&
+		len(d.EgressRules.Added) == 0 && len(d.EgressRules.Removed) == 0 &&
+		len(d.AddedSets) == 0 && len(d.RemovedSets) == 0 && len(d.Sets) == 0 &&
+		len(d.AddedMaps) == 0 && len(d.RemovedMaps) == 0 && len(d.Maps) == 0 &&
+		len(d.AddedChains) == 0 && len(d.RemovedChains) == 0 && len(d.Chains) == 0
+}
+
+// ruleKey identifies a rule within a chain.
+func ruleKey(r Rule) string {
+	return string(r.Family) + " " + r.String()
+}
+
+// diffRules returns the rules that were added and removed in their order, duplicate rules are counted.
+func diffRules(oldRules, newRules []Rule) RulesDiff {
+	d := RulesDiff{}
+	count := map[string]int{}
+	for _, r := range oldRules {
+		count[ruleKey(r)]++
+	}
+	for _, r := range newRules {
+		k := ruleKey(r)
+		if count[k] > 0 {
+			count[k]--
+			continue
+		}
+		d.Added = append(d.Added, r)
+	}
+	// the remaining counts are the old rules that are not part of the new rules
+	for i := len(oldRules) - 1; i >= 0; i-- {
+		k := ruleKey(oldRules[i])
+		if count[k] > 0 {
+			count[k]--
+			d.Removed = append([]Rule{oldRules[i]}, d.Removed...)
+		}
+	}
+	return d
+}
+
+// diffElements returns the elements that were added and removed, nil if the elements did not change.
+func diffElements(fam Family, name string, oldElements, newElements []string) *ElementsDiff {
+	d := &ElementsDiff{Family: fam, Name: name}
+	old := map[string]bool{}
+	for _, e := range oldElements {
+		old[e] = true
+	}
+	current := map[string]bool{}
+	for _, e := range newElements {
+		current[e] = true
+		if !old[e] {
+			d.Added = append(d.Added, e)
+		}
+	}
+	for _, e := range oldElements {
+		if !current[e] {
+			d.Removed = append(d.Removed, e)
+		}
+	}
+	if len(d.Added) == 0 && len(d.Removed) == 0 {
+		return nil
+	}
+	return d
+}
@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		old  *FirewallRules
+		new  *FirewallRules
+		want *Diff
+	}{
+		{
+			name: "initialization",
+			old:  nil,
+			new: &FirewallRules{
+				IngressRules: []Rule{rule("allow ingress 1")},
+				Sets:         []Set{{Family: FamilyIPv4, Name: "np_1", Elements: []string{"10.0.0.1"}}},
+			},
+			want: &Diff{
+				IngressRules: RulesDiff{Added: []Rule{rule("allow ingress 1")}},
+				AddedSets:    []Set{{Family: FamilyIPv4, Name: "np_1", Elements: []string{"10.0.0.1"}}},
+			},
+		},
+		{
+			name: "unchanged rules of different origin",
+			old: &FirewallRules{
+				IngressRules: []Rule{newRule(FamilyIPv4, nil, "allow", Origin{Kind: "Service", Name: "a"})},
+			},
+			new: &FirewallRules{
+				IngressRules: []Rule{newRule(FamilyIPv4, nil, "allow", Origin{Kind: "Service", Name: "b"})},
+			},
+			want: &Diff{},
+		},
+		{
+			name: "added and removed rules",
+			old: &FirewallRules{
+				IngressRules: []Rule{rule("allow ingress 1"), rule("allow ingress 2")},
+				EgressRules:  []Rule{rule("allow egress 1")},
+			},
+			new: &FirewallRules{
+				IngressRules: []Rule{rule("allow ingress 2"), rule("allow ingress 3")},
+				EgressRules:  []Rule{rule("allow egress 1")},
+			},
+			want: &Diff{
+				IngressRules: RulesDiff{Added: []Rule{rule("allow ingress 3")}, Removed: []Rule{rule("allow ingress 1")}},
+			},
+		},
+		{
+			name: "duplicate rules are counted",
+			old: &FirewallRules{
+				Chains: []Chain{{Family: FamilyIPv4, Name: "svc_1", Rules: []Rule{rule("allow"), rule("allow")}}},
+			},
+			new: &FirewallRules{
+				Chains: []Chain{{Family: FamilyIPv4, Name: "svc_1", Rules: []Rule{rule("allow")}}},
+			},
+			want: &Diff{
+				Chains: []ChainDiff{{Family: FamilyIPv4, Name: "svc_1", RulesDiff: RulesDiff{Removed: []Rule{rule("allow")}}}},
+			},
+		},
+		{
+			name: "changed set elements",
+			old: &FirewallRules{
+				Sets: []Set{{Family: FamilyIPv4, Name: "np_1", Elements: []string{"10.0.0.1", "10.0.0.2"}}},
+			},
+			new: &FirewallRules{
+				Sets: []Set{{Family: FamilyIPv4, Name: "np_1", Elements: []string{"10.0.0.2", "10.0.0.3"}}},
+			},
+			want: &Diff{
+				Sets: []ElementsDiff{{Family: FamilyIPv4, Name: "np_1", Added: []string{"10.0.0.3"}, Removed: []string{"10.0.0.1"}}},
+			},
+		},
+		{
+			name: "changed set type",
+			old: &FirewallRules{
+				Sets: []Set{{Family: FamilyIPv4, Name: "services_tcp", Elements: []string{"10.0.0.1"}}},
+			},
+			new: &FirewallRules{
+				Sets: []Set{{Family: FamilyIPv4, Name: "services_tcp", Ports: true, Elements: []string{"10.0.0.1 . 443"}}},
+			},
+			want: &Diff{
+				AddedSets:   []Set{{Family: FamilyIPv4, Name: "services_tcp", Ports: true, Elements: []string{"10.0.0.1 . 443"}}},
+				RemovedSets: []Set{{Family: FamilyIPv4, Name: "services_tcp", Elements: []string{"10.0.0.1"}}},
+			},
+		},
+		{
+			name: "sets of the same name in different families",
+			old: &FirewallRules{
+				Sets: []Set{{Family: FamilyIPv4, Name: "np_1"}},
+			},
+			new: &FirewallRules{
+				Sets: []Set{{Family: FamilyIPv6, Name: "np_1"}},
+			},
+			want: &Diff{
+				AddedSets:   []Set{{Family: FamilyIPv6, Name: "np_1"}},
+				RemovedSets: []Set{{Family: FamilyIPv4, Name: "np_1"}},
+			},
+		},
+		{
+			name: "changed map verdicts and chains",
+			old: &FirewallRules{
+				Maps:   []VerdictMap{{Family: FamilyIPv4, Name: "services_tcp_restricted", Elements: []string{"10.0.0.1 . 443 : jump svc_1"}}},
+				Chains: []Chain{{Family: FamilyIPv4, Name: "svc_1", Rules: []Rule{rule("allow 1")}}},
+			},
+			new: &FirewallRules{
+				Maps:   []VerdictMap{{Family: FamilyIPv4, Name: "services_tcp_restricted", Elements: []string{"10.0.0.1 . 443 : jump svc_2"}}},
+				Chains: []Chain{{Family: FamilyIPv4, Name: "svc_2", Rules: []Rule{rule("allow 2")}}},
+			},
+			want: &Diff{
+				Maps: []ElementsDiff{{
+					Family:  FamilyIPv4,
+					Name:    "services_tcp_restricted",
+					Added:   []string{"10.0.0.1 . 443 : jump svc_2"},
+					Removed: []string{"10.0.0.1 . 443 : jump svc_1"},
+				}},
+				AddedChains:   []Chain{{Family: FamilyIPv4, Name: "svc_2", Rules: []Rule{rule("allow 2")}}},
+				RemovedChains: []Chain{{Family: FamilyIPv4, Name: "svc_1", Rules: []Rule{rule("allow 1")}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.new.Diff(tt.old)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff() = %+v, want %+v", got, tt.want)
+			}
+			if got.Empty() != reflect.DeepEqual(tt.want, &Diff{}) {
+				t.Errorf("Empty() = %t", got.Empty())
+			}
+		})
+	}
+}
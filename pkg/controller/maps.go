@@ -0,0 +1,265 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// VerdictMap is a named nftables map of concatenated destination addresses and destination ports to verdicts.
+// Its elements are rendered like "10.0.0.1 . 443 : jump svc_0123456789abcdef".
+type VerdictMap struct {
+	Family   Family
+	Name     string
+	Elements []string
+}
+
+// Type returns the nftables data type of the elements of the map.
+func (m VerdictMap) Type() string {
+	return m.Family.addressType() + " . inet_service : verdict"
+}
+
+// Chain is a regular nftables chain that is jumped to from a verdict map.
+type Chain struct {
+	Family Family
+	Name   string
+	Rules  []Rule
+}
+
+// restriction holds the source networks that may access an address and port and the services that expose it
+// by namespace and name.
+type restriction struct {
+	sources map[string]bool
+	origins map[string]Origin
+}
+
+// aggregateServices assembles the rules for services with a constant number of rules per protocol. Addresses
+// and ports that are open for all sources are collected in a concatenated named set, addresses and ports that
+// are limited to source ranges are looked up in a verdict map that jumps to a chain which checks the source ranges.
+// Services that share the same source ranges share the same chain. With ObjectCounters all addresses and ports are
+// looked up in verdict maps that jump to a chain per service instead, see accountServices.
+func (fr *FirewallResources) aggregateServices(services []corev1.Service, fam Family) *FirewallRules {
+	open := map[string]map[string]*restriction{}
+	restricted := map[string]map[string]*restriction{}
+	result := &FirewallRules{}
+	for _, svc := range services {
+		sources := serviceSources(svc, fam)
+		if len(sources) == 0 {
+			continue
+		}
+		all := false
+		for _, s := range sources {
+			all = all || s == fam.all()
+		}
+		origin := Origin{Kind: "Service", Namespace: svc.ObjectMeta.Namespace, Name: svc.ObjectMeta.Name}
+		add := func(addresses []string, ports map[string][]string) {
+			for proto, ps := range ports {
+				for _, a := range addresses {
+					for _, p := range ps {
+						element := fmt.Sprintf("%s . %s", a, p)
+						elements := restricted
+						if all {
+							elements = open
+						}
+						if elements[proto] == nil {
+							elements[proto] = map[string]*restriction{}
+						}
+						r, ok := elements[proto][element]
+						if !ok {
+							r = &restriction{sources: map[string]bool{}, origins: map[string]Origin{}}
+							elements[proto][element] = r
+						}
+						for _, s := range sources {
+							r.sources[s] = true
+						}
+						r.origins[svc.ObjectMeta.Namespace+"/"+svc.ObjectMeta.Name] = origin
+					}
+				}
+			}
+		}
+
+		ips := fam.filter(fr.serviceIPs(svc))
+		if len(ips) > 0 {
+			add(ips, fr.servicePorts(svc))
+			l4protos := fr.serviceProtocols(svc, fam)
+			if len(l4protos) > 0 {
+				common := []AddressMatch{{Direction: Source, Addresses: sources}, {Direction: Destination, Addresses: ips}}
+				comment := fmt.Sprintf("accept traffic for k8s service %s/%s", svc.ObjectMeta.Namespace, svc.ObjectMeta.Name)
+				result.IngressRules = append(result.IngressRules, newRule(fam, common, comment, origin).withProtocols(l4protos))
+			}
+		}
+		nodeIPs := fam.filter(fr.nodeIPs())
+		if hasNodePorts(svc) && len(nodeIPs) > 0 {
+			add(nodeIPs, nodePorts(svc))
+		}
+	}
+
+	chains := map[string]*restriction{}
+	for _, proto := range protocols {
+		if fr.config.ObjectCounters {
+			accountServices(result, chains, fam, proto, open[proto], restricted[proto])
+			continue
+		}
+		if len(open[proto]) > 0 {
+			name := fmt.Sprintf("services_%s", proto)
+			elements := []string{}
+			origins := map[string]Origin{}
+			for element, r := range open[proto] {
+				elements = append(elements, element)
+				for k, o := range r.origins {
+					origins[k] = o
+				}
+			}
+			sort.Strings(elements)
+			result.Sets = append(result.Sets, Set{Family: fam, Name: name, Ports: true, Elements: elements})
+			result.IngressRules = append(result.IngressRules, Rule{
+				Family:   fam,
+				Protocol: proto,
+				PortSet:  name,
+				Counter:  true,
+				Verdict:  VerdictAccept,
+				Comment:  fmt.Sprintf("accept %s traffic for k8s services", proto),
+				Origins:  sortedOrigins(origins),
+			})
+		}
+		elements := []string{}
+		origins := map[string]Origin{}
+		for element, r := range restricted[proto] {
+			// the address and port is accepted for all sources anyway
+			if _, ok := open[proto][element]; ok {
+				continue
+			}
+			elements = append(elements, fmt.Sprintf("%s : jump %s", element, addChain(chains, fam, r, false)))
+			for k, o := range r.origins {
+				origins[k] = o
+			}
+		}
+		if len(elements) > 0 {
+			sort.Strings(elements)
+			name := fmt.Sprintf("services_%s_restricted", proto)
+			result.Maps = append(result.Maps, VerdictMap{Family: fam, Name: name, Elements: elements})
+			result.IngressRules = append(result.IngressRules, Rule{
+				Family:   fam,
+				Protocol: proto,
+				PortMap:  name,
+				Comment:  fmt.Sprintf("check sources of %s traffic for k8s services with source ranges", proto),
+				Origins:  sortedOrigins(origins),
+			})
+		}
+	}
+
+	for _, name := range sortedChainNames(chains) {
+		c := chains[name]
+		origins := []string{}
+		for o := range c.origins {
+			origins = append(origins, o)
+		}
+		sort.Strings(origins)
+		comment := fmt.Sprintf("accept traffic for k8s service %s", origins[0])
+		if len(origins) > 1 {
+			comment = fmt.Sprintf("accept traffic for k8s services %s", strings.Join(origins, ", "))
+		}
+		// the source ranges of services that share an address and port may overlap, the intervals of a set must not
+		rule := newRule(fam, []AddressMatch{{Direction: Source, Addresses: aggregateAddresses(keys(c.sources))}}, comment, Origin{})
+		rule.Origins = sortedOrigins(c.origins)
+		result.Chains = append(result.Chains, Chain{Family: fam, Name: name, Rules: []Rule{rule}})
+	}
+	return result
+}
+
+// accountServices looks up all addresses and ports of the protocol in a single verdict map that jumps to a chain
+// per service, so that the counters of the chains can be attributed to the services. Addresses and ports that
+// are open for all sources are accepted by chains that check no source ranges.
+func accountServices(result *FirewallRules, chains map[string]*restriction, fam Family, proto string, open, restricted map[string]*restriction) {
+	all := map[string]*restriction{}
+	for element, r := range restricted {
+		all[element] = r
+	}
+	// the address and port is accepted for all sources anyway
+	for element, r := range open {
+		all[element] = r
+	}
+	if len(all) == 0 {
+		return
+	}
+	elements := []string{}
+	origins := map[string]Origin{}
+	for element, r := range all {
+		elements = append(elements, fmt.Sprintf("%s : jump %s", element, addChain(chains, fam, r, true)))
+		for k, o := range r.origins {
+			origins[k] = o
+		}
+	}
+	sort.Strings(elements)
+	name := fmt.Sprintf("services_%s", proto)
+	result.Maps = append(result.Maps, VerdictMap{Family: fam, Name: name, Elements: elements})
+	result.IngressRules = append(result.IngressRules, Rule{
+		Family:   fam,
+		Protocol: proto,
+		PortMap:  name,
+		Comment:  fmt.Sprintf("check %s traffic for k8s services", proto),
+		Origins:  sortedOrigins(origins),
+	})
+}
+
+// addChain merges the services of the restriction into the restriction of the chain that checks the same source
+// networks, after overlapping networks are aggregated, and returns the name of the chain. With byOrigin only the restrictions of the same services share
+// a chain.
+func addChain(chains map[string]*restriction, fam Family, r *restriction, byOrigin bool) string {
+	key := fmt.Sprintf("%s/%s", fam, strings.Join(aggregateAddresses(keys(r.sources)), ","))
+	if byOrigin {
+		names := []string{}
+		for k := range r.origins {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		key = fmt.Sprintf("%s/%s", key, strings.Join(names, ","))
+	}
+	h := sha256.Sum256([]byte(key))
+	name := fmt.Sprintf("svc_%x", h[:8])
+	c, ok := chains[name]
+	if !ok {
+		c = &restriction{sources: r.sources, origins: map[string]Origin{}}
+		chains[name] = c
+	}
+	for k, o := range r.origins {
+		c.origins[k] = o
+	}
+	return name
+}
+
+func sortedChainNames(chains map[string]*restriction) []string {
+	r := []string{}
+	for name := range chains {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// sortedOrigins returns the origins sorted by their keys.
+func sortedOrigins(m map[string]Origin) []Origin {
+	names := []string{}
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	r := []Origin{}
+	for _, k := range names {
+		r = append(r, m[k])
+	}
+	return r
+}
+
+// keys returns the sorted keys of the map.
+func keys(m map[string]bool) []string {
+	r := []string{}
+	for k := range m {
+		r = append(r, k)
+	}
+	sort.Strings(r)
+	return r
+}
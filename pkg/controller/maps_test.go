@@ -0,0 +1,141 @@
+package controller
+
+import (
+	"fmt"
+	"testing"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// loadBalancers creates n services of type LoadBalancer, every fourth service is limited to source ranges.
+func loadBalancers(n int) *corev1.ServiceList {
+	l := &corev1.ServiceList{}
+	for i := 0; i < n; i++ {
+		svc := corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("svc-%d", i), Namespace: fmt.Sprintf("ns-%d", i%100)},
+			Spec: corev1.ServiceSpec{
+				Type: corev1.ServiceTypeLoadBalancer,
+				Ports: []corev1.ServicePort{
+					{Protocol: corev1.ProtocolTCP, Port: 443},
+					{Protocol: corev1.ProtocolUDP, Port: int32(1000 + i%1000)},
+				},
+			},
+			Status: corev1.ServiceStatus{
+				LoadBalancer: corev1.LoadBalancerStatus{
+					Ingress: []corev1.LoadBalancerIngress{
+						{IP: fmt.Sprintf("10.%d.%d.%d", i/65536, (i/256)%256, i%256)},
+						{IP: fmt.Sprintf("2001:db8::%x", i)},
+					},
+				},
+			},
+		}
+		if i%4 == 0 {
+			svc.Spec.LoadBalancerSourceRanges = []string{fmt.Sprintf("185.%d.0.0/16", i%10), fmt.Sprintf("2001:db8:%x::/48", i%10)}
+		}
+		l.Items = append(l.Items, svc)
+	}
+	return l
+}
+
+func BenchmarkRenderServices(b *testing.B) {
+	services := loadBalancers(10000)
+	for _, mode := range []RenderMode{RenderModeRules, RenderModeMaps} {
+		b.Run(string(mode), func(b *testing.B) {
+			var rules *FirewallRules
+			for i := 0; i < b.N; i++ {
+				fr := &FirewallResources{
+					NetworkPolicyList: &networkingv1.NetworkPolicyList{},
+					ServiceList:       services,
+					logger:            zap.NewNop().Sugar(),
+					config:            Config{RenderMode: mode},
+				}
+				var err error
+				rules, err = fr.assembleRules()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err = rules.Render(); err != nil {
+					b.Fatal(err)
+				}
+				if _, err = rules.RenderV6(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(rules.IngressRules)), "rules")
+		})
+	}
+}
+
+func TestObjectCounters(t *testing.T) {
+	lb := func(name, ip string, sources ...string) corev1.Service {
+		return corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "shop"},
+			Spec: corev1.ServiceSpec{
+				Type:                     corev1.ServiceTypeLoadBalancer,
+				LoadBalancerSourceRanges: sources,
+				Ports:                    []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 443}},
+			},
+			Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{{IP: ip}}}},
+		}
+	}
+	// the rules of the services only differ in their destination addresses and are merged without ObjectCounters
+	services := &corev1.ServiceList{Items: []corev1.Service{
+		lb("web-1", "212.37.83.1", "185.0.0.0/16"),
+		lb("web-2", "212.37.83.2", "185.0.0.0/16"),
+		lb("open-1", "212.37.83.3"),
+		lb("open-2", "212.37.83.4"),
+	}}
+	tests := []struct {
+		mode           RenderMode
+		objectCounters bool
+		wantShared     bool
+	}{
+		{mode: RenderModeRules, wantShared: true},
+		{mode: RenderModeMaps, wantShared: true},
+		{mode: RenderModeRules, objectCounters: true},
+		{mode: RenderModeMaps, objectCounters: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%t", tt.mode, tt.objectCounters), func(t *testing.T) {
+			fr := &FirewallResources{
+				NetworkPolicyList: &networkingv1.NetworkPolicyList{},
+				ServiceList:       services,
+				logger:            zap.NewNop().Sugar(),
+				config:            Config{RenderMode: tt.mode, ObjectCounters: tt.objectCounters},
+			}
+			rules, err := fr.assembleRules()
+			if err != nil {
+				t.Fatal(err)
+			}
+			counting := append([]Rule{}, rules.IngressRules...)
+			for _, c := range rules.Chains {
+				counting = append(counting, c.Rules...)
+			}
+			shared := false
+			counted := map[string]int{}
+			for _, r := range counting {
+				if !r.Counter || r.Family != FamilyIPv4 {
+					continue
+				}
+				if len(r.Origins) != 1 {
+					shared = true
+					continue
+				}
+				counted[r.Origins[0].Name]++
+			}
+			if shared != tt.wantShared {
+				t.Errorf("got shared counting rules %t, want %t:\n%s", shared, tt.wantShared, renderRules(counting))
+			}
+			if tt.objectCounters {
+				for _, svc := range services.Items {
+					if counted[svc.ObjectMeta.Name] != 1 {
+						t.Errorf("service %s has %d counting rules, want its own rule:\n%s", svc.ObjectMeta.Name, counted[svc.ObjectMeta.Name], renderRules(counting))
+					}
+				}
+			}
+		})
+	}
+}
@@ -1,6 +1,30 @@
 package controller
 
-const nftableTemplateIpv4 = `table ip firewall {
+// nftableTemplate renders the table of a family, the family specific parts are passed as tableData.
+const nftableTemplate = `table {{ .Family }} {{ .Table }} {
+{{- range .Sets }}
+	set {{ .Name }} {
+		type {{ .Type }}
+		{{- if .Elements }}
+		elements = { {{ join .Elements ", " }} }
+		{{- end }}
+	}
+{{ end }}
+{{- range .Chains }}
+	chain {{ .Name }} {
+		{{- range .Rules }}
+		{{ . }}
+		{{- end }}
+	}
+{{ end }}
+{{- range .Maps }}
+	map {{ .Name }} {
+		type {{ .Type }}
+		{{- if .Elements }}
+		elements = { {{ join .Elements ", " }} }
+		{{- end }}
+	}
+{{ end }}
 	chain forward {
 		type filter hook forward priority 1; policy drop;
 
@@ -8,9 +32,9 @@ const nftableTemplateIpv4 = `table ip firewall {
 		ct state established,related counter accept comment "accept established connections"
 		ct state invalid counter drop comment "drop packets with invalid ct state"
 
-		# icmp
-		ip protocol icmp icmp type echo-request limit rate over 10/second burst 4 packets counter drop comment "drop ping floods"
-		ip protocol icmp icmp type { destination-unreachable, router-solicitation, router-advertisement, time-exceeded, parameter-problem } counter accept comment "accept icmp"
+		# {{ .ICMP.Name }}
+		{{ .ICMP.Match }} type echo-request limit rate over 10/second burst 4 packets counter drop comment "drop ping floods"
+		{{ .ICMP.Match }} type { {{ join .ICMP.Types ", " }} } counter accept comment "accept {{ .ICMP.Name }}"
 
 		# dynamic ingress rules
 		{{- range .IngressRules }}
@@ -26,3 +50,40 @@ const nftableTemplateIpv4 = `table ip firewall {
 		limit rate 10/second counter packets 1 bytes 40 log prefix "nftables-firewall-dropped: "
 	}
 }`
+
+// TableName is the name of the tables of both families that hold the rules of the controller.
+const TableName = "firewall"
+
+// icmpRules holds the icmp protocol of a family for the static icmp rules of the forward chain.
+type icmpRules struct {
+	// Name is the name of the protocol, used in the comments
+	Name string
+	// Match matches the icmp packets of the family
+	Match string
+	// Types are the icmp types that are accepted
+	Types []string
+}
+
+// tableData is the data the table of a family is rendered with.
+type tableData struct {
+	*FirewallRules
+	Family Family
+	Table  string
+	ICMP   icmpRules
+}
+
+// icmp returns the icmp protocol of the family.
+func (f Family) icmp() icmpRules {
+	if f == FamilyIPv6 {
+		return icmpRules{
+			Name:  "icmpv6",
+			Match: "meta l4proto ipv6-icmp icmpv6",
+			Types: []string{"destination-unreachable", "packet-too-big", "time-exceeded", "parameter-problem", "nd-router-solicit", "nd-router-advert"},
+		}
+	}
+	return icmpRules{
+		Name:  "icmp",
+		Match: "ip protocol icmp icmp",
+		Types: []string{"destination-unreachable", "router-solicitation", "router-advertisement", "time-exceeded", "parameter-problem"},
+	}
+}
@@ -0,0 +1,344 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// prefix is an address or network, IPv4 prefixes are held as IPv4-mapped IPv6 prefixes.
+type prefix struct {
+	addr [16]byte
+	bits int
+	v4   bool
+}
+
+func parsePrefix(s string) (prefix, error) {
+	p := prefix{}
+	ip, n, err := net.ParseCIDR(s)
+	if err != nil {
+		ip = net.ParseIP(s)
+		if ip == nil {
+			return p, fmt.Errorf("invalid address or network %q", s)
+		}
+		n = &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}
+		if ip4 := ip.To4(); ip4 != nil {
+			n = &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+		}
+	}
+	ones, size := n.Mask.Size()
+	copy(p.addr[:], n.IP.To16())
+	p.v4 = size == 32 && ip.To4() != nil
+	p.bits = ones
+	if p.v4 {
+		p.bits += 96
+	}
+	return p, nil
+}
+
+func (p prefix) String() string {
+	ip := net.IP(p.addr[:])
+	if p.bits == 128 {
+		return ip.String()
+	}
+	if p.v4 {
+		return fmt.Sprintf("%s/%d", ip, p.bits-96)
+	}
+	return fmt.Sprintf("%s/%d", ip, p.bits)
+}
+
+func (p prefix) bit(i int) bool {
+	return p.addr[i/8]&(0x80>>(i%8)) != 0
+}
+
+// contains checks whether the prefix contains the other prefix.
+func (p prefix) contains(o prefix) bool {
+	if p.v4 != o.v4 || p.bits > o.bits {
+		return false
+	}
+	for i := 0; i < p.bits; i++ {
+		if p.bit(i) != o.bit(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// parent returns the prefix that is one bit shorter.
+func (p prefix) parent() prefix {
+	p.bits--
+	p.addr[p.bits/8] &^= 0x80 >> (p.bits % 8)
+	return p
+}
+
+// siblings checks whether the prefixes are the two halves of their common parent prefix.
+func siblings(a, b prefix) bool {
+	minBits := 96
+	if !a.v4 {
+		minBits = 0
+	}
+	return a.v4 == b.v4 && a.bits == b.bits && a.bits > minBits && !a.bit(a.bits-1) && b.bit(b.bits-1) && a.parent() == b.parent()
+}
+
+// aggregateAddresses collapses overlapping and adjacent addresses and networks into the smallest list of
+// networks that covers exactly the same addresses. Invalid entries are kept as they are.
+func aggregateAddresses(addrs []string) []string {
+	prefixes := []prefix{}
+	invalid := []string{}
+	for _, a := range addrs {
+		p, err := parsePrefix(a)
+		if err != nil {
+			invalid = append(invalid, a)
+			continue
+		}
+		prefixes = append(prefixes, p)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if c := bytes.Compare(prefixes[i].addr[:], prefixes[j].addr[:]); c != 0 {
+			return c < 0
+		}
+		return prefixes[i].bits < prefixes[j].bits
+	})
+	// a network is sorted before all the prefixes it contains
+	disjoint := []prefix{}
+	for _, p := range prefixes {
+		if len(disjoint) > 0 && disjoint[len(disjoint)-1].contains(p) {
+			continue
+		}
+		disjoint = append(disjoint, p)
+	}
+	merged := []prefix{}
+	for _, p := range disjoint {
+		merged = append(merged, p)
+		for len(merged) > 1 && siblings(merged[len(merged)-2], merged[len(merged)-1]) {
+			parent := merged[len(merged)-1].parent()
+			merged = append(merged[:len(merged)-2], parent)
+		}
+	}
+	r := []string{}
+	for _, p := range merged {
+		r = append(r, p.String())
+	}
+	return append(r, invalid...)
+}
+
+// aggregatePorts collapses overlapping and adjacent ports and port ranges into the smallest list of port ranges
+// that covers exactly the same ports. Invalid entries are kept as they are.
+func aggregatePorts(ports []string) []string {
+	type portRange struct{ from, to int }
+	ranges := []portRange{}
+	invalid := []string{}
+	for _, p := range ports {
+		bounds := strings.SplitN(p, "-", 2)
+		from, err := strconv.Atoi(bounds[0])
+		to := from
+		if err == nil && len(bounds) == 2 {
+			to, err = strconv.Atoi(bounds[1])
+		}
+		if err != nil || to < from {
+			invalid = append(invalid, p)
+			continue
+		}
+		ranges = append(ranges, portRange{from: from, to: to})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].from < ranges[j].from })
+	merged := []portRange{}
+	for _, pr := range ranges {
+		last := len(merged) - 1
+		if last >= 0 && pr.from <= merged[last].to+1 {
+			if pr.to > merged[last].to {
+				merged[last].to = pr.to
+			}
+			continue
+		}
+		merged = append(merged, pr)
+	}
+	r := []string{}
+	for _, pr := range merged {
+		if pr.from == pr.to {
+			r = append(r, strconv.Itoa(pr.from))
+			continue
+		}
+		r = append(r, fmt.Sprintf("%d-%d", pr.from, pr.to))
+	}
+	return append(r, invalid...)
+}
+
+// dimension is a part of a rule that matches packets against a list of values. Rules that only differ in
+// the values of one dimension match the union of these values when they are merged.
+type dimension struct {
+	name string
+	// values returns the values of the rule, nil if the dimension cannot be merged for the rule
+	values func(r Rule) []string
+	// with returns a copy of the rule with the values
+	with func(r Rule, values []string) Rule
+}
+
+// addressDimension is the dimension of the address match at the index. Negated matches are not merged because
+// the union of two negated matches is not the negation of the union of their addresses.
+func addressDimension(index int) dimension {
+	return dimension{
+		name: fmt.Sprintf("address/%d", index),
+		values: func(r Rule) []string {
+			if index >= len(r.Addresses) || r.Addresses[index].Set != "" || r.Addresses[index].Negated {
+				return nil
+			}
+			return r.Addresses[index].Addresses
+		},
+		with: func(r Rule, values []string) Rule {
+			addresses := append([]AddressMatch{}, r.Addresses...)
+			addresses[index].Addresses = aggregateAddresses(values)
+			r.Addresses = addresses
+			return r
+		},
+	}
+}
+
+var portsDimension = dimension{
+	name:   "ports",
+	values: func(r Rule) []string { return r.Ports },
+	with: func(r Rule, values []string) Rule {
+		r.Ports = aggregatePorts(values)
+		return r
+	},
+}
+
+var protocolsDimension = dimension{
+	name:   "protocols",
+	values: func(r Rule) []string { return r.Protocols },
+	with: func(r Rule, values []string) Rule {
+		r.Protocols = unique(values)
+		return r
+	},
+}
+
+// optimizeRules aggregates the addresses and ports of the rules and merges rules that only differ in one
+// dimension until no more rules can be merged. The optimized rules accept exactly the same packets.
+// Only rules with a verdict are merged, rules that look up verdicts in verdict maps are left as they are.
+// With byOrigin only the rules of the same k8s entities are merged.
+func optimizeRules(rules []Rule, byOrigin bool) []Rule {
+	result := []Rule{}
+	maxAddresses := 0
+	for _, r := range rules {
+		addresses := []AddressMatch{}
+		for _, a := range r.Addresses {
+			if a.Set == "" {
+				a.Addresses = aggregateAddresses(a.Addresses)
+			}
+			addresses = append(addresses, a)
+		}
+		r.Addresses = addresses
+		if len(r.Ports) > 0 {
+			r.Ports = aggregatePorts(r.Ports)
+		}
+		if len(r.Addresses) > maxAddresses {
+			maxAddresses = len(r.Addresses)
+		}
+		result = append(result, r)
+	}
+	result = uniqueSortedRules(result)
+
+	dimensions := []dimension{}
+	for i := 0; i < maxAddresses; i++ {
+		dimensions = append(dimensions, addressDimension(i))
+	}
+	dimensions = append(dimensions, portsDimension, protocolsDimension)
+	for {
+		merged := false
+		for _, d := range dimensions {
+			var m bool
+			result, m = mergeRules(result, d, byOrigin)
+			merged = merged || m
+		}
+		if !merged {
+			return result
+		}
+	}
+}
+
+// mergeRules merges the rules that only differ in the values of the dimension and returns whether rules were merged.
+// With byOrigin rules of different origins are not merged.
+func mergeRules(rules []Rule, d dimension, byOrigin bool) ([]Rule, bool) {
+	groups := map[string][]Rule{}
+	order := []string{}
+	for _, r := range rules {
+		key := r.String()
+		if r.Verdict != "" && r.PortSet == "" && r.PortMap == "" && len(d.values(r)) > 0 {
+			blank := d.with(r, nil)
+			blank.Comment = ""
+			key = fmt.Sprintf("%s %s %s: %s", d.name, r.Family, r.Protocol, blank.String())
+			if byOrigin {
+				key = fmt.Sprintf("%s %v", key, r.Origins)
+			}
+		}
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], r)
+	}
+	if len(order) == len(rules) {
+		return rules, false
+	}
+	result := []Rule{}
+	for _, key := range order {
+		group := groups[key]
+		if len(group) == 1 {
+			result = append(result, group[0])
+			continue
+		}
+		values := []string{}
+		comments := []string{}
+		origins := []Origin{}
+		for _, r := range group {
+			values = append(values, d.values(r)...)
+			comments = append(comments, r.Comment)
+			origins = append(origins, r.Origins...)
+		}
+		r := d.with(group[0], values)
+		r.Origins = uniqueOrigins(origins)
+		r.Comment = mergedComment(comments, r.Origins)
+		result = append(result, r)
+	}
+	return uniqueSortedRules(result), true
+}
+
+// mergedComment keeps the comment of merged rules if they share the same comment and lists their origins otherwise.
+func mergedComment(comments []string, origins []Origin) string {
+	if len(unique(comments)) == 1 {
+		return comments[0]
+	}
+	kinds := []string{}
+	names := map[string][]string{}
+	for _, o := range origins {
+		if _, ok := names[o.Kind]; !ok {
+			kinds = append(kinds, o.Kind)
+		}
+		names[o.Kind] = append(names[o.Kind], o.Namespace+"/"+o.Name)
+	}
+	sort.Strings(kinds)
+	parts := []string{}
+	for _, k := range kinds {
+		kind, ok := pluralKinds[k]
+		if !ok {
+			kind = k
+		}
+		parts = append(parts, fmt.Sprintf("%s %s", kind, strings.Join(names[k], ", ")))
+	}
+	return "accept traffic for k8s " + strings.Join(parts, " and ")
+}
+
+var pluralKinds = map[string]string{
+	"NetworkPolicy": "network policies",
+	"Service":       "services",
+}
+
+func uniqueOrigins(origins []Origin) []Origin {
+	t := map[string]Origin{}
+	for _, o := range origins {
+		t[o.String()] = o
+	}
+	return sortedOrigins(t)
+}
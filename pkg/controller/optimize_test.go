@@ -0,0 +1,294 @@
+package controller
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAggregateAddresses(t *testing.T) {
+	tests := []struct {
+		name  string
+		addrs []string
+		want  []string
+	}{
+		{name: "empty", addrs: nil, want: []string{}},
+		{name: "single address", addrs: []string{"10.0.0.1"}, want: []string{"10.0.0.1"}},
+		{name: "host prefix", addrs: []string{"10.0.0.1/32"}, want: []string{"10.0.0.1"}},
+		{name: "contained network", addrs: []string{"10.1.0.0/16", "10.0.0.0/8"}, want: []string{"10.0.0.0/8"}},
+		{name: "contained address", addrs: []string{"10.0.0.0/8", "10.2.3.4"}, want: []string{"10.0.0.0/8"}},
+		{name: "adjacent networks", addrs: []string{"10.3.0.0/16", "10.2.0.0/16"}, want: []string{"10.2.0.0/15"}},
+		{name: "adjacent addresses", addrs: []string{"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3"}, want: []string{"10.0.0.0/30"}},
+		{name: "adjacent but not aligned", addrs: []string{"10.0.0.1", "10.0.0.2"}, want: []string{"10.0.0.1", "10.0.0.2"}},
+		{name: "cascading merge", addrs: []string{"10.0.0.0/25", "10.0.1.0/24", "10.0.0.128/25"}, want: []string{"10.0.0.0/23"}},
+		{name: "all addresses", addrs: []string{"0.0.0.0/1", "128.0.0.0/1", "10.0.0.1"}, want: []string{"0.0.0.0/0"}},
+		{name: "ipv6", addrs: []string{"fd00::/9", "fd80::/9", "2001:db8::1"}, want: []string{"2001:db8::1", "fd00::/8"}},
+		{name: "invalid entries are kept", addrs: []string{"foo", "10.0.0.1"}, want: []string{"10.0.0.1", "foo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := aggregateAddresses(tt.addrs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("aggregateAddresses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregatePorts(t *testing.T) {
+	tests := []struct {
+		name  string
+		ports []string
+		want  []string
+	}{
+		{name: "single port", ports: []string{"80"}, want: []string{"80"}},
+		{name: "sorted", ports: []string{"443", "80"}, want: []string{"80", "443"}},
+		{name: "duplicates", ports: []string{"80", "80"}, want: []string{"80"}},
+		{name: "adjacent ports", ports: []string{"80", "81", "82"}, want: []string{"80-82"}},
+		{name: "overlapping ranges", ports: []string{"8000-8080", "8080", "8050-8100"}, want: []string{"8000-8100"}},
+		{name: "contained range", ports: []string{"30000-32767", "30080"}, want: []string{"30000-32767"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := aggregatePorts(tt.ports); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("aggregatePorts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// packet is the part of a packet that rules match against.
+type packet struct {
+	saddr net.IP
+	daddr net.IP
+	proto string
+	dport int
+}
+
+// evaluator decides which packets are accepted by rules, independently of the optimizer.
+type evaluator struct {
+	sets map[string][]string
+	// networks caches the parsed addresses and networks
+	networks map[string]*net.IPNet
+}
+
+func (e evaluator) contains(addrs []string, ip net.IP) bool {
+	for _, a := range addrs {
+		n, ok := e.networks[a]
+		if !ok {
+			_, n, _ = net.ParseCIDR(a)
+			if ip := net.ParseIP(a); ip != nil {
+				n = &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}
+			}
+			e.networks[a] = n
+		}
+		if n != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e evaluator) matches(r Rule, p packet) bool {
+	for _, a := range r.Addresses {
+		ip := p.saddr
+		if a.Direction == Destination {
+			ip = p.daddr
+		}
+		addrs := a.Addresses
+		if a.Set != "" {
+			addrs = e.sets[a.Set]
+		}
+		if e.contains(addrs, ip) == a.Negated {
+			return false
+		}
+	}
+	if len(r.Ports) > 0 {
+		if p.proto != r.Protocol {
+			return false
+		}
+		inRange := false
+		for _, port := range r.Ports {
+			bounds := strings.SplitN(port, "-", 2)
+			from, _ := strconv.Atoi(bounds[0])
+			to := from
+			if len(bounds) == 2 {
+				to, _ = strconv.Atoi(bounds[1])
+			}
+			inRange = inRange || (p.dport >= from && p.dport <= to)
+		}
+		if !inRange {
+			return false
+		}
+	}
+	if len(r.Protocols) > 0 {
+		found := false
+		for _, proto := range r.Protocols {
+			found = found || proto == p.proto
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (e evaluator) accepts(rules []Rule, p packet) bool {
+	for _, r := range rules {
+		if r.Verdict == VerdictAccept && e.matches(r, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleGenerator creates random rules within a small address and port space, so that rules often overlap,
+// share dimensions and can be checked exhaustively.
+type ruleGenerator struct {
+	rnd  *rand.Rand
+	fam  Family
+	base net.IP
+}
+
+// address returns the address with the offset in the address space of the generator.
+func (g ruleGenerator) address(offset int) net.IP {
+	ip := make(net.IP, len(g.base))
+	copy(ip, g.base)
+	ip[len(ip)-1] += byte(offset)
+	return ip
+}
+
+// addresses returns between one and three random networks of the 16 addresses of the generator.
+func (g ruleGenerator) addresses() []string {
+	r := []string{}
+	for i := g.rnd.Intn(3); i >= 0; i-- {
+		size := 1 << g.rnd.Intn(5)
+		ip := g.address(g.rnd.Intn(16) / size * size)
+		bits := 8*len(ip) - log2(size)
+		if size == 1 && g.rnd.Intn(2) == 0 {
+			r = append(r, ip.String())
+			continue
+		}
+		r = append(r, fmt.Sprintf("%s/%d", ip, bits))
+	}
+	return r
+}
+
+func log2(n int) int {
+	r := 0
+	for n > 1 {
+		n >>= 1
+		r++
+	}
+	return r
+}
+
+// ports returns between one and three random ports or port ranges between 1 and 16.
+func (g ruleGenerator) ports() []string {
+	r := []string{}
+	for i := g.rnd.Intn(3); i >= 0; i-- {
+		from := 1 + g.rnd.Intn(16)
+		if g.rnd.Intn(3) == 0 {
+			r = append(r, fmt.Sprintf("%d-%d", from, from+g.rnd.Intn(17-from)))
+			continue
+		}
+		r = append(r, fmt.Sprint(from))
+	}
+	return r
+}
+
+func (g ruleGenerator) rules() []Rule {
+	// a small pool of values makes rules that only differ in one dimension likely
+	pool := [][]string{g.addresses(), g.addresses(), g.addresses()}
+	pick := func() []string {
+		if g.rnd.Intn(3) == 0 {
+			return g.addresses()
+		}
+		return pool[g.rnd.Intn(len(pool))]
+	}
+	rules := []Rule{}
+	for i := g.rnd.Intn(8); i >= 0; i-- {
+		matches := []AddressMatch{}
+		switch g.rnd.Intn(3) {
+		case 0:
+			matches = append(matches, AddressMatch{Direction: Source, Set: "set1"})
+		case 1:
+			matches = append(matches, AddressMatch{Direction: Source, Addresses: pick()})
+		}
+		if g.rnd.Intn(3) == 0 {
+			matches = append(matches, AddressMatch{Direction: Destination, Addresses: pick(), Negated: true})
+		}
+		matches = append(matches, AddressMatch{Direction: Destination, Addresses: pick()})
+		origin := Origin{Kind: "Service", Namespace: "default", Name: fmt.Sprintf("svc-%d", i)}
+		rule := newRule(g.fam, matches, fmt.Sprintf("rule %d", i), origin)
+		proto := []string{"tcp", "udp"}[g.rnd.Intn(2)]
+		switch g.rnd.Intn(3) {
+		case 0:
+			rule = rule.withPorts(proto, g.ports())
+		case 1:
+			rule = rule.withProtocols([]string{proto, "gre"}[:1+g.rnd.Intn(2)])
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// TestOptimizeRulesIsEquivalent checks for random rule sets that the optimized rules accept exactly the same
+// packets as the original rules by evaluating every packet of the address and port space of the rules.
+func TestOptimizeRulesIsEquivalent(t *testing.T) {
+	for _, fam := range families {
+		base := net.ParseIP("10.0.0.0").To4()
+		if fam == FamilyIPv6 {
+			base = net.ParseIP("fd00::")
+		}
+		for seed := int64(0); seed < 200; seed++ {
+			g := ruleGenerator{rnd: rand.New(rand.NewSource(seed)), fam: fam, base: base}
+			e := evaluator{sets: map[string][]string{"set1": g.addresses()}, networks: map[string]*net.IPNet{}}
+			rules := g.rules()
+			optimized := optimizeRules(rules, false)
+			if len(optimized) > len(rules) {
+				t.Errorf("%s seed %d: optimized rules %d exceed original rules %d", fam, seed, len(optimized), len(rules))
+			}
+			for s := 0; s < 16; s++ {
+				for d := 0; d < 16; d++ {
+					for _, proto := range []string{"tcp", "udp", "gre"} {
+						for port := 0; port <= 17; port++ {
+							p := packet{saddr: g.address(s), daddr: g.address(d), proto: proto, dport: port}
+							if e.accepts(rules, p) != e.accepts(optimized, p) {
+								t.Fatalf("%s seed %d: packet %+v is accepted by original rules %t and optimized rules %t\noriginal:\n%s\noptimized:\n%s",
+									fam, seed, p, e.accepts(rules, p), e.accepts(optimized, p), renderRules(rules), renderRules(optimized))
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestOptimizeRulesMergesOrigins(t *testing.T) {
+	a := newRule(FamilyIPv4, []AddressMatch{{Direction: Destination, Addresses: []string{"10.0.0.1"}}}, "accept traffic for k8s service default/a", Origin{Kind: "Service", Namespace: "default", Name: "a"}).withPorts("tcp", []string{"443"})
+	b := newRule(FamilyIPv4, []AddressMatch{{Direction: Destination, Addresses: []string{"10.0.0.2"}}}, "accept traffic for k8s service default/b", Origin{Kind: "Service", Namespace: "default", Name: "b"}).withPorts("tcp", []string{"443"})
+	got := optimizeRules([]Rule{a, b}, false)
+	if len(got) != 1 {
+		t.Fatalf("optimizeRules() = %v, want a single rule", got)
+	}
+	want := `ip daddr { 10.0.0.1, 10.0.0.2 } tcp dport { 443 } counter accept comment "accept traffic for k8s services default/a, default/b"`
+	if got[0].String() != want {
+		t.Errorf("optimizeRules() = %s, want %s", got[0], want)
+	}
+	if len(got[0].Origins) != 2 {
+		t.Errorf("optimizeRules() origins = %v, want both origins", got[0].Origins)
+	}
+}
+
+func renderRules(rules []Rule) string {
+	r := []string{}
+	for _, rule := range rules {
+		r = append(r, rule.String())
+	}
+	return strings.Join(r, "\n")
+}
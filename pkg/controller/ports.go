@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// protocols are the protocols with destination ports that rules are generated for, in the order of rendering.
+var protocols = []string{"tcp", "udp", "sctp"}
+
+func isPortProtocol(proto string) bool {
+	for _, p := range protocols {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// portSpec holds the destination ports of a protocol, all is set if all ports of the protocol are allowed.
+type portSpec struct {
+	all   bool
+	ports []string
+}
+
+// destinations are the pods the traffic of a rule is sent to.
+type destinations struct {
+	// description names the destinations in errors
+	description string
+	pods        []corev1.Pod
+	// known is not set if the destinations are not known as pods, like the addresses of ip blocks
+	known bool
+}
+
+// destinationPorts returns the destination ports of the network policy ports by protocol, a port without
+// a port number allows all ports of its protocol.
+// Named ports are resolved against the container ports of the destination pods,
+// ports that cannot be resolved or use an unsupported protocol are reported and left out.
+func (fr *FirewallResources) destinationPorts(np networkingv1.NetworkPolicy, ports []networkingv1.NetworkPolicyPort, dst destinations) map[string]*portSpec {
+	r := map[string]*portSpec{}
+	for _, p := range ports {
+		proto := proto(p.Protocol)
+		if !isPortProtocol(proto) {
+			fr.logger.Warnw("skipping port of network policy with unsupported protocol", "namespace", np.ObjectMeta.Namespace, "name", np.ObjectMeta.Name, "port", fmt.Sprint(p.Port), "protocol", proto)
+			fr.leaveOut("NetworkPolicy", np.ObjectMeta, fmt.Sprintf("port %s: unsupported protocol %s", fmt.Sprint(p.Port), proto))
+			continue
+		}
+		if p.Port == nil {
+			r[proto] = &portSpec{all: true}
+			continue
+		}
+		resolved, err := resolvePort(p, dst)
+		if err != nil {
+			fr.logger.Warnw("skipping port of network policy", "namespace", np.ObjectMeta.Namespace, "name", np.ObjectMeta.Name, "port", fmt.Sprint(p.Port), "error", err)
+			fr.leaveOut("NetworkPolicy", np.ObjectMeta, fmt.Sprintf("port %s: %s", fmt.Sprint(p.Port), err))
+			continue
+		}
+		ps, ok := r[proto]
+		if !ok {
+			ps = &portSpec{}
+			r[proto] = ps
+		}
+		if !ps.all {
+			ps.ports = append(ps.ports, resolved...)
+		}
+	}
+	return r
+}
+
+// resolvePort returns the nftables port expressions for a network policy port, port ranges are rendered
+// as nftables ranges. The port is expected to be validated by validateNetworkPolicy.
+func resolvePort(p networkingv1.NetworkPolicyPort, dst destinations) ([]string, error) {
+	if p.Port.Type == intstr.String {
+		return resolveNamedPort(p.Port.StrVal, p.Protocol, dst)
+	}
+	if p.EndPort != nil && int(*p.EndPort) > p.Port.IntValue() {
+		return []string{fmt.Sprintf("%d-%d", p.Port.IntValue(), *p.EndPort)}, nil
+	}
+	return []string{fmt.Sprint(p.Port.IntValue())}, nil
+}
+
+// resolveNamedPort resolves a named port to the port numbers of the matching container ports of the
+// destination pods.
+func resolveNamedPort(name string, protocol *corev1.Protocol, dst destinations) ([]string, error) {
+	if !dst.known {
+		return nil, fmt.Errorf("named port %q cannot be resolved for %s", name, dst.description)
+	}
+	p := corev1.ProtocolTCP
+	if protocol != nil {
+		p = *protocol
+	}
+	found := map[int32]bool{}
+	for _, pod := range dst.pods {
+		for _, c := range pod.Spec.Containers {
+			for _, cp := range c.Ports {
+				cpp := cp.Protocol
+				if cpp == "" {
+					cpp = corev1.ProtocolTCP
+				}
+				if cp.Name == name && cpp == p && validatePort(int(cp.ContainerPort)) == nil {
+					found[cp.ContainerPort] = true
+				}
+			}
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("named port %q could not be resolved to a %s container port of %s", name, p, dst.description)
+	}
+	ports := []int{}
+	for cp := range found {
+		ports = append(ports, int(cp))
+	}
+	sort.Ints(ports)
+	r := []string{}
+	for _, cp := range ports {
+		r = append(r, fmt.Sprint(cp))
+	}
+	return r, nil
+}
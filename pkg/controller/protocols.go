@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// annotationProtocols is the service annotation that lists additional protocols without ports, e.g. "gre, esp".
+// Traffic of these protocols is accepted towards the addresses of the service.
+const annotationProtocols = "firewall.metal-stack.io/protocols"
+
+// portlessProtocols maps the supported protocols without ports to their nftables protocol name per family.
+var portlessProtocols = map[string]map[Family]string{
+	"gre":  {FamilyIPv4: "gre", FamilyIPv6: "gre"},
+	"esp":  {FamilyIPv4: "esp", FamilyIPv6: "esp"},
+	"ah":   {FamilyIPv4: "ah", FamilyIPv6: "ah"},
+	"icmp": {FamilyIPv4: "icmp", FamilyIPv6: "ipv6-icmp"},
+}
+
+// serviceProtocols returns the nftables names of the protocols without ports that are annotated at the service.
+func (fr *FirewallResources) serviceProtocols(svc corev1.Service, fam Family) []string {
+	a, ok := svc.ObjectMeta.Annotations[annotationProtocols]
+	if !ok {
+		return nil
+	}
+	r := []string{}
+	seen := map[string]bool{}
+	for _, p := range strings.Split(a, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		names, ok := portlessProtocols[p]
+		if !ok {
+			fr.logger.Warnw("skipping unsupported protocol of service", "namespace", svc.ObjectMeta.Namespace, "name", svc.ObjectMeta.Name, "protocol", p)
+			fr.leaveOut("Service", svc.ObjectMeta, fmt.Sprintf("annotation %s: unsupported protocol %s", annotationProtocols, p))
+			continue
+		}
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		r = append(r, names[fam])
+	}
+	return r
+}
@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Resolver resolves host names to addresses, it is satisfied by net.Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// hostResolver resolves the host names of load balancers in the background and caches the result for the resolve
+// interval, so the fetches of k8s resources only read the cache and host names are re-resolved periodically.
+type hostResolver struct {
+	resolver Resolver
+	interval time.Duration
+	logger   *zap.SugaredLogger
+	now      func() time.Time
+
+	mu      sync.Mutex
+	cache   map[string]resolvedHost
+	pending map[string]bool
+	// used holds the host names of the last resolve, lookups of other host names are dropped when they finish
+	used map[string]bool
+	// changed is called when the addresses of a host name changed in the background
+	changed func()
+	running sync.WaitGroup
+}
+
+type resolvedHost struct {
+	ips      []string
+	resolved time.Time
+}
+
+func newHostResolver(resolver Resolver, interval time.Duration, logger *zap.SugaredLogger) *hostResolver {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &hostResolver{
+		resolver: resolver,
+		interval: interval,
+		logger:   logger,
+		now:      time.Now,
+		cache:    map[string]resolvedHost{},
+		pending:  map[string]bool{},
+		used:     map[string]bool{},
+	}
+}
+
+// resolve returns the cached addresses of the host names, host names that were not resolved yet have no
+// addresses. Host names that are not cached or whose resolve interval passed are resolved in parallel in the
+// background. Host names that cannot be resolved keep the addresses of their last successful resolution.
+func (h *hostResolver) resolve(hosts []string) map[string][]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := map[string][]string{}
+	for _, host := range hosts {
+		if _, ok := r[host]; ok {
+			continue
+		}
+		c, ok := h.cache[host]
+		if (!ok || h.now().Sub(c.resolved) >= h.interval) && !h.pending[host] {
+			h.pending[host] = true
+			h.running.Add(1)
+			go h.update(host)
+		}
+		r[host] = c.ips
+	}
+	// forget host names that are not used anymore
+	h.used = map[string]bool{}
+	for host := range r {
+		h.used[host] = true
+	}
+	for host := range h.cache {
+		if !h.used[host] {
+			delete(h.cache, host)
+		}
+	}
+	return r
+}
+
+// update resolves the host name and calls changed if its addresses changed. The result is dropped if the host
+// name is not used anymore.
+func (h *hostResolver) update(host string) {
+	defer h.running.Done()
+	ips, err := h.lookup(host)
+	h.mu.Lock()
+	delete(h.pending, host)
+	if !h.used[host] {
+		h.mu.Unlock()
+		return
+	}
+	if err != nil {
+		h.mu.Unlock()
+		h.logger.Warnw("could not resolve host name", "host", host, "error", err)
+		return
+	}
+	old, ok := h.cache[host]
+	h.cache[host] = resolvedHost{ips: ips, resolved: h.now()}
+	changed := h.changed
+	h.mu.Unlock()
+	if changed != nil && (!ok || !reflect.DeepEqual(old.ips, ips)) {
+		changed()
+	}
+}
+
+// onChange sets the function that is called when the addresses of a host name changed.
+func (h *hostResolver) onChange(f func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.changed = f
+}
+
+// wait waits until the running resolutions are done.
+func (h *hostResolver) wait() {
+	h.running.Wait()
+}
+
+func (h *hostResolver) lookup(host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := h.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := []string{}
+	for _, a := range addrs {
+		ips = append(ips, a.IP.String())
+	}
+	sort.Strings(ips)
+	return ips, nil
+}
@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type countingResolver struct {
+	mu      sync.Mutex
+	ips     map[string][]string
+	lookups int
+}
+
+func (r *countingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	return staticResolver(r.ips).LookupIPAddr(ctx, host)
+}
+
+func TestHostResolver(t *testing.T) {
+	now := time.Now()
+	r := &countingResolver{ips: map[string][]string{"lb.example.com": {"212.37.83.2", "212.37.83.1"}}}
+	h := newHostResolver(r, time.Minute, zap.NewNop().Sugar())
+	h.now = func() time.Time { return now }
+	changes := 0
+	h.onChange(func() { changes++ })
+
+	// resolved in the background
+	got := h.resolve([]string{"lb.example.com", "lb.example.com"})
+	assert.Equal(t, map[string][]string{"lb.example.com": nil}, got)
+	h.wait()
+	assert.Equal(t, 1, changes)
+	got = h.resolve([]string{"lb.example.com"})
+	assert.Equal(t, map[string][]string{"lb.example.com": {"212.37.83.1", "212.37.83.2"}}, got)
+	assert.Equal(t, 1, r.lookups)
+
+	// cached within the resolve interval
+	r.ips["lb.example.com"] = []string{"212.37.83.3"}
+	got = h.resolve([]string{"lb.example.com"})
+	assert.Equal(t, []string{"212.37.83.1", "212.37.83.2"}, got["lb.example.com"])
+	assert.Equal(t, 1, r.lookups)
+
+	// resolved again after the resolve interval
+	now = now.Add(time.Minute)
+	h.resolve([]string{"lb.example.com"})
+	h.wait()
+	got = h.resolve([]string{"lb.example.com"})
+	assert.Equal(t, []string{"212.37.83.3"}, got["lb.example.com"])
+	assert.Equal(t, 2, r.lookups)
+	assert.Equal(t, 2, changes)
+
+	// failed resolutions keep the last known addresses
+	r.mu.Lock()
+	delete(r.ips, "lb.example.com")
+	r.mu.Unlock()
+	now = now.Add(time.Minute)
+	h.resolve([]string{"lb.example.com", "unknown.example.com"})
+	h.wait()
+	got = h.resolve([]string{"lb.example.com", "unknown.example.com"})
+	h.wait()
+	assert.Equal(t, []string{"212.37.83.3"}, got["lb.example.com"])
+	assert.Empty(t, got["unknown.example.com"])
+	assert.Equal(t, 6, r.lookups)
+	assert.Equal(t, 2, changes)
+
+	// unused host names are forgotten
+	h.resolve(nil)
+	assert.Empty(t, h.cache, fmt.Sprintf("%v", h.cache))
+}
+
+// blockingResolver blocks lookups until it is released.
+type blockingResolver struct {
+	started chan string
+	release chan struct{}
+}
+
+func (r *blockingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.started <- host
+	<-r.release
+	return staticResolver{host: {"212.37.83.1"}}.LookupIPAddr(ctx, host)
+}
+
+func TestHostResolverParallel(t *testing.T) {
+	r := &blockingResolver{started: make(chan string, 2), release: make(chan struct{})}
+	h := newHostResolver(r, time.Minute, zap.NewNop().Sugar())
+
+	// the fetch does not wait for the lookups, which run at the same time
+	got := h.resolve([]string{"a.example.com", "b.example.com"})
+	assert.Equal(t, map[string][]string{"a.example.com": nil, "b.example.com": nil}, got)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-r.started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("host names are not resolved in parallel")
+		}
+	}
+	// pending lookups are not started again
+	h.resolve([]string{"a.example.com", "b.example.com"})
+	close(r.release)
+	h.wait()
+	assert.Empty(t, r.started)
+	got = h.resolve([]string{"a.example.com", "b.example.com"})
+	assert.Equal(t, map[string][]string{"a.example.com": {"212.37.83.1"}, "b.example.com": {"212.37.83.1"}}, got)
+}
+
+func TestHostResolverDropsUnusedLookups(t *testing.T) {
+	r := &blockingResolver{started: make(chan string, 1), release: make(chan struct{})}
+	h := newHostResolver(r, time.Minute, zap.NewNop().Sugar())
+	changes := 0
+	h.onChange(func() { changes++ })
+
+	h.resolve([]string{"a.example.com"})
+	select {
+	case <-r.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("host name is not resolved")
+	}
+	// the host name is not used anymore while it is looked up
+	h.resolve(nil)
+	close(r.release)
+	h.wait()
+	assert.Empty(t, h.cache)
+	assert.Equal(t, 0, changes)
+}
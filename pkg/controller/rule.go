@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Family is the nftables address family of a rule.
+type Family string
+
+// Direction is the address of a packet an address match applies to.
+type Direction string
+
+// Verdict is the verdict of a rule for matching packets.
+type Verdict string
+
+const (
+	// FamilyIPv4 is the family of rules in the ip table.
+	FamilyIPv4 Family = "ip"
+	// FamilyIPv6 is the family of rules in the ip6 table.
+	FamilyIPv6 Family = "ip6"
+
+	// Source matches the source address of a packet.
+	Source Direction = "saddr"
+	// Destination matches the destination address of a packet.
+	Destination Direction = "daddr"
+
+	// VerdictAccept accepts matching packets.
+	VerdictAccept Verdict = "accept"
+)
+
+// AddressMatch matches the source or destination address of a packet against a named set or a list of
+// addresses and networks.
+type AddressMatch struct {
+	Direction Direction
+	Set       string
+	Addresses []string
+	Negated   bool
+}
+
+// Origin is a k8s entity a rule was generated for.
+type Origin struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+// Rule is a single nftables rule of the firewall. All address matches, the protocol match with its
+// destination ports and the protocols without ports must match for the verdict to apply.
+type Rule struct {
+	Family    Family
+	Addresses []AddressMatch
+	// Protocol is the protocol the destination ports belong to
+	Protocol string
+	Ports    []string
+	// Protocols are matched without ports
+	Protocols []string
+	// PortSet is a named set of concatenated destination addresses and destination ports of the protocol
+	PortSet string
+	// PortMap is a named verdict map of concatenated destination addresses and destination ports of the protocol,
+	// its verdicts take the place of the verdict of the rule
+	PortMap string
+	Counter bool
+	Verdict Verdict
+	Comment string
+	// Origins are the k8s entities the rule was generated for, rules that are merged by the optimizer have
+	// more than one origin
+	Origins []Origin
+}
+
+// newRule creates a counting rule that accepts packets matching the addresses.
+func newRule(fam Family, addresses []AddressMatch, comment string, origin Origin) Rule {
+	return Rule{
+		Family:    fam,
+		Addresses: addresses,
+		Counter:   true,
+		Verdict:   VerdictAccept,
+		Comment:   comment,
+		Origins:   []Origin{origin},
+	}
+}
+
+// withPorts returns a copy of the rule that matches the destination ports of the protocol.
+func (r Rule) withPorts(protocol string, ports []string) Rule {
+	r.Protocol = protocol
+	r.Ports = ports
+	return r
+}
+
+// withProtocols returns a copy of the rule that matches the protocols.
+func (r Rule) withProtocols(protocols []string) Rule {
+	r.Protocols = protocols
+	return r
+}
+
+// String renders the rule in nftables syntax.
+func (r Rule) String() string {
+	parts := []string{}
+	for _, a := range r.Addresses {
+		parts = append(parts, a.render(r.Family))
+	}
+	switch {
+	case r.PortSet != "":
+		parts = append(parts, fmt.Sprintf("%s daddr . %s dport @%s", r.Family, r.Protocol, r.PortSet))
+	case r.PortMap != "":
+		parts = append(parts, fmt.Sprintf("%s daddr . %s dport vmap @%s", r.Family, r.Protocol, r.PortMap))
+	case r.Protocol != "" && len(r.Ports) > 0:
+		parts = append(parts, fmt.Sprintf("%s dport { %s }", r.Protocol, strings.Join(r.Ports, ", ")))
+	}
+	if len(r.Protocols) > 0 {
+		parts = append(parts, fmt.Sprintf("meta l4proto { %s }", strings.Join(r.Protocols, ", ")))
+	}
+	if r.Counter {
+		parts = append(parts, "counter")
+	}
+	if r.Verdict != "" {
+		parts = append(parts, string(r.Verdict))
+	}
+	if r.Comment != "" {
+		parts = append(parts, "comment", fmt.Sprintf(`"%s"`, escapeComment(r.Comment)))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (a AddressMatch) render(fam Family) string {
+	op := ""
+	if a.Negated {
+		op = "!= "
+	}
+	if a.Set != "" {
+		return fmt.Sprintf("%s %s %s@%s", fam, a.Direction, op, a.Set)
+	}
+	return fmt.Sprintf("%s %s %s{ %s }", fam, a.Direction, op, strings.Join(a.Addresses, ", "))
+}
+
+// String returns the kind, namespace and name of the origin.
+func (o Origin) String() string {
+	if o.Name == "" {
+		return o.Kind
+	}
+	if o.Namespace == "" {
+		return fmt.Sprintf("%s %s", o.Kind, o.Name)
+	}
+	return fmt.Sprintf("%s %s/%s", o.Kind, o.Namespace, o.Name)
+}
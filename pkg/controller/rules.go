@@ -2,56 +2,188 @@ package controller
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"sort"
 	"strings"
 	"text/template"
 
+	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 // FirewallResources holds the k8s entities that serve as input for the generation of firewall rules.
 type FirewallResources struct {
 	NetworkPolicyList *networkingv1.NetworkPolicyList
 	ServiceList       *corev1.ServiceList
+	PodList           *corev1.PodList
+	NamespaceList     *corev1.NamespaceList
+	NodeList          *corev1.NodeList
+	// HostIPs holds the resolved addresses of the load balancer host names
+	HostIPs map[string][]string
+
+	logger   *zap.SugaredLogger
+	config   Config
+	sets     map[Family]map[string]Set
+	statuses map[Origin]*ObjectStatus
 }
 
-// FirewallRules hold the nftable rules that are generated from k8s entities.
+// FirewallRules hold the nftable rules of both families that are generated from k8s entities.
 type FirewallRules struct {
-	IngressRules []string
-	EgressRules  []string
+	IngressRules []Rule
+	EgressRules  []Rule
+	Sets         []Set
+	Maps         []VerdictMap
+	Chains       []Chain
+	// Statuses holds the enforcement status of the services and network policies the rules were assembled from,
+	// it is not part of the ruleset itself
+	Statuses []ObjectStatus
+	// StalePolicy is set for the rules of the stale policy that replace the rules of stale k8s entities, it is not
+	// part of the ruleset itself
+	StalePolicy bool
+}
+
+var families = []Family{FamilyIPv4, FamilyIPv6}
+
+// all returns the network that matches all addresses of the family.
+func (f Family) all() string {
+	if f == FamilyIPv6 {
+		return "::/0"
+	}
+	return "0.0.0.0/0"
+}
+
+// addressType returns the nftables data type of the addresses of the family.
+func (f Family) addressType() string {
+	if f == FamilyIPv6 {
+		return "ipv6_addr"
+	}
+	return "ipv4_addr"
+}
+
+// filter returns the addresses or networks that belong to the family in their canonical form,
+// invalid addresses are left out.
+func (f Family) filter(addrs []string) []string {
+	r := []string{}
+	for _, a := range addrs {
+		canonical, fam, err := parseAddress(a)
+		if err == nil && fam == f {
+			r = append(r, canonical)
+		}
+	}
+	return r
 }
 
 func (fr *FirewallResources) assembleRules() (*FirewallRules, error) {
 	result := &FirewallRules{}
-	for _, np := range fr.NetworkPolicyList.Items {
-		hasEgress := false
-		hasIngress := false
-		for _, pt := range np.Spec.PolicyTypes {
-			switch strings.ToLower(string(pt)) {
-			case "ingress":
+	policies := fr.enforcedNetworkPolicies()
+	services := fr.exposedServices()
+	for _, fam := range families {
+		ingress := []Rule{}
+		egress := []Rule{}
+		for _, np := range policies {
+			hasEgress := false
+			hasIngress := false
+			// without explicit policy types a policy always affects ingress and affects egress if it has egress rules
+			if len(np.Spec.PolicyTypes) == 0 {
 				hasIngress = true
-			case "egress":
-				hasEgress = true
-			case "both":
-				hasIngress = true
-				hasEgress = true
+				hasEgress = len(np.Spec.Egress) > 0
+			}
+			for _, pt := range np.Spec.PolicyTypes {
+				switch strings.ToLower(string(pt)) {
+				case "ingress":
+					hasIngress = true
+				case "egress":
+					hasEgress = true
+				case "both":
+					hasIngress = true
+					hasEgress = true
+				}
+			}
+			if hasEgress {
+				egress = append(egress, fr.egressRulesForNetworkPolicy(np, fam)...)
+			}
+			if hasIngress {
+				ingress = append(ingress, fr.ingressRulesForNetworkPolicy(np, fam)...)
 			}
 		}
-		if hasEgress {
-			result.EgressRules = append(result.EgressRules, egressRulesForNetworkPolicy(np)...)
+		if fr.config.RenderMode == RenderModeMaps {
+			aggregated := fr.aggregateServices(services, fam)
+			ingress = append(ingress, aggregated.IngressRules...)
+			result.Maps = append(result.Maps, aggregated.Maps...)
+			result.Chains = append(result.Chains, aggregated.Chains...)
+			result.Sets = append(result.Sets, aggregated.Sets...)
+		} else {
+			for _, svc := range services {
+				ingress = append(ingress, fr.ingressRulesForService(svc, fam)...)
+			}
 		}
-		if hasIngress {
-			result.IngressRules = append(result.IngressRules, ingressRulesForNetworkPolicy(np)...)
+		result.EgressRules = append(result.EgressRules, optimizeRules(egress, fr.config.ObjectCounters)...)
+		result.IngressRules = append(result.IngressRules, optimizeRules(ingress, fr.config.ObjectCounters)...)
+		result.Sets = append(result.Sets, fr.setsOf(fam)...)
+	}
+	result.Statuses = fr.objectStatuses()
+	return result, nil
+}
+
+// enforcedNetworkPolicies returns the valid network policies of the namespaces that are configured for enforcement.
+// The network policies of all namespaces are only enforced with AllPolicyNamespaces, without it, configured
+// namespaces or namespace selector no network policies are enforced.
+func (fr *FirewallResources) enforcedNetworkPolicies() []networkingv1.NetworkPolicy {
+	r := []networkingv1.NetworkPolicy{}
+	for _, np := range fr.namespacedNetworkPolicies() {
+		if err := validateNetworkPolicy(np); err != nil {
+			fr.logger.Errorw("rejecting invalid network policy", "namespace", np.ObjectMeta.Namespace, "name", np.ObjectMeta.Name, "error", err)
+			fr.reject("NetworkPolicy", np.ObjectMeta, err.Error())
+			continue
 		}
+		fr.enforce("NetworkPolicy", np.ObjectMeta)
+		r = append(r, np)
 	}
-	for _, svc := range fr.ServiceList.Items {
-		result.IngressRules = append(result.IngressRules, ingressRulesForService(svc)...)
+	return r
+}
+
+func (fr *FirewallResources) namespacedNetworkPolicies() []networkingv1.NetworkPolicy {
+	if fr.config.AllPolicyNamespaces {
+		return fr.NetworkPolicyList.Items
+	}
+	enforced := map[string]bool{}
+	for _, ns := range fr.config.PolicyNamespaces {
+		enforced[ns] = true
+	}
+	if fr.config.PolicyNamespaceSelector != nil && fr.NamespaceList != nil {
+		for _, ns := range fr.NamespaceList.Items {
+			if fr.config.PolicyNamespaceSelector.Matches(labels.Set(ns.ObjectMeta.Labels)) {
+				enforced[ns.ObjectMeta.Name] = true
+			}
+		}
+	}
+	r := []networkingv1.NetworkPolicy{}
+	for _, np := range fr.NetworkPolicyList.Items {
+		if !enforced[np.ObjectMeta.Namespace] {
+			reason := fr.skipReason(np.ObjectMeta.Namespace)
+			fr.logger.Infow("skipping network policy", "namespace", np.ObjectMeta.Namespace, "name", np.ObjectMeta.Name, "reason", reason)
+			fr.reject("NetworkPolicy", np.ObjectMeta, reason)
+			continue
+		}
+		r = append(r, np)
+	}
+	return r
+}
+
+func (fr *FirewallResources) skipReason(namespace string) string {
+	switch {
+	case len(fr.config.PolicyNamespaces) > 0 && fr.config.PolicyNamespaceSelector != nil:
+		return fmt.Sprintf("namespace %s is not one of the enforced namespaces %v and does not match the namespace selector %q", namespace, fr.config.PolicyNamespaces, fr.config.PolicyNamespaceSelector)
+	case len(fr.config.PolicyNamespaces) > 0:
+		return fmt.Sprintf("namespace %s is not one of the enforced namespaces %v", namespace, fr.config.PolicyNamespaces)
+	case fr.config.PolicyNamespaceSelector == nil:
+		return "network policies are not enforced in any namespace"
+	default:
+		return fmt.Sprintf("namespace %s does not match the namespace selector %q", namespace, fr.config.PolicyNamespaceSelector)
 	}
-	result.EgressRules = uniqueSorted(result.EgressRules)
-	result.IngressRules = uniqueSorted(result.IngressRules)
-	return result, nil
 }
 
 // HasChanged checks whether new firewall rules have changed in comparison to the last run
@@ -60,27 +192,156 @@ func (r *FirewallRules) HasChanged(oldRules *FirewallRules) bool {
 		return true
 	}
 
-	if len(r.IngressRules) != len(oldRules.IngressRules) {
-		return true
+	return !equalRules(r.IngressRules, oldRules.IngressRules) ||
+		!equalRules(r.EgressRules, oldRules.EgressRules) ||
+		!equalSets(r.Sets, oldRules.Sets) ||
+		!equalMaps(r.Maps, oldRules.Maps) ||
+		!equalChains(r.Chains, oldRules.Chains)
+}
+
+// Hash returns a short hash that identifies the rules, rules that have not changed in comparison to each other
+// have the same hash.
+func (r *FirewallRules) Hash() string {
+	h := sha256.New()
+	for _, i := range r.IngressRules {
+		fmt.Fprintf(h, "ingress %s %s\n", i.Family, i)
+	}
+	for _, e := range r.EgressRules {
+		fmt.Fprintf(h, "egress %s %s\n", e.Family, e)
+	}
+	for _, s := range r.Sets {
+		fmt.Fprintf(h, "set %s %s %t %s\n", s.Family, s.Name, s.Ports, strings.Join(s.Elements, ","))
+	}
+	for _, m := range r.Maps {
+		fmt.Fprintf(h, "map %s %s %s\n", m.Family, m.Name, strings.Join(m.Elements, ","))
+	}
+	for _, c := range r.Chains {
+		fmt.Fprintf(h, "chain %s %s\n", c.Family, c.Name)
+		for _, rule := range c.Rules {
+			fmt.Fprintf(h, "%s\n", rule)
+		}
 	}
+	return fmt.Sprintf("%x", h.Sum(nil)[:8])
+}
 
-	if len(r.EgressRules) != len(oldRules.EgressRules) {
-		return true
+// Of returns the rules and sets of the family.
+func (r *FirewallRules) Of(fam Family) *FirewallRules {
+	result := &FirewallRules{
+		IngressRules: []Rule{},
+		EgressRules:  []Rule{},
+		Sets:         []Set{},
+		Maps:         []VerdictMap{},
+		Chains:       []Chain{},
+	}
+	for _, i := range r.IngressRules {
+		if i.Family == fam {
+			result.IngressRules = append(result.IngressRules, i)
+		}
+	}
+	for _, e := range r.EgressRules {
+		if e.Family == fam {
+			result.EgressRules = append(result.EgressRules, e)
+		}
+	}
+	for _, s := range r.Sets {
+		if s.Family == fam {
+			result.Sets = append(result.Sets, s)
+		}
+	}
+	for _, m := range r.Maps {
+		if m.Family == fam {
+			result.Maps = append(result.Maps, m)
+		}
+	}
+	for _, c := range r.Chains {
+		if c.Family == fam {
+			result.Chains = append(result.Chains, c)
+		}
+	}
+	return result
+}
+
+func equalRules(a, b []Rule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if b[k].Family != v.Family || b[k].String() != v.String() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func equalSets(a, b []Set) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if b[k].Family != v.Family || b[k].Name != v.Name || b[k].Ports != v.Ports || !equal(b[k].Elements, v.Elements) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func equalMaps(a, b []VerdictMap) bool {
+	if len(a) != len(b) {
+		return false
 	}
 
-	for k, v := range r.IngressRules {
-		if oldRules.IngressRules[k] != v {
-			return true
+	for k, v := range a {
+		if b[k].Family != v.Family || b[k].Name != v.Name || !equal(b[k].Elements, v.Elements) {
+			return false
 		}
 	}
 
-	for k, v := range r.EgressRules {
-		if oldRules.EgressRules[k] != v {
-			return true
+	return true
+}
+
+func equalChains(a, b []Chain) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if b[k].Family != v.Family || b[k].Name != v.Name || !equalRules(b[k].Rules, v.Rules) {
+			return false
 		}
 	}
 
-	return false
+	return true
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// unique removes duplicates from the elements and keeps their order
+func unique(elements []string) []string {
+	t := map[string]bool{}
+	r := []string{}
+	for _, e := range elements {
+		if !t[e] {
+			t[e] = true
+			r = append(r, e)
+		}
+	}
+	return r
 }
 
 func uniqueSorted(elements []string) []string {
@@ -96,158 +357,181 @@ func uniqueSorted(elements []string) []string {
 	return r
 }
 
-// Render renders the firewall rules to a string
+// uniqueSortedRules removes rules that render to the same nftables rule and sorts them by their rendering,
+// the origins of removed rules are kept.
+func uniqueSortedRules(rules []Rule) []Rule {
+	t := map[string]Rule{}
+	for _, r := range rules {
+		if e, ok := t[r.String()]; ok {
+			e.Origins = uniqueOrigins(append(append([]Origin{}, e.Origins...), r.Origins...))
+			t[r.String()] = e
+			continue
+		}
+		t[r.String()] = r
+	}
+	keys := []string{}
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	r := []Rule{}
+	for _, k := range keys {
+		r = append(r, t[k])
+	}
+	return r
+}
+
+// Render renders the ipv4 firewall rules to a string
 func (r *FirewallRules) Render() (string, error) {
+	return r.Of(FamilyIPv4).render(FamilyIPv4)
+}
+
+// RenderV6 renders the ipv6 firewall rules to a string
+func (r *FirewallRules) RenderV6() (string, error) {
+	return r.Of(FamilyIPv6).render(FamilyIPv6)
+}
+
+func (r *FirewallRules) render(fam Family) (string, error) {
 	var b bytes.Buffer
-	tpl := template.Must(template.New("v4").Parse(nftableTemplateIpv4))
-	err := tpl.Execute(&b, r)
+	tpl := template.Must(template.New("nftables").Funcs(template.FuncMap{"join": strings.Join}).Parse(nftableTemplate))
+	err := tpl.Execute(&b, tableData{FirewallRules: r, Family: fam, Table: TableName, ICMP: fam.icmp()})
 	if err != nil {
 		return "", err
 	}
 	return b.String(), nil
 }
 
-func ingressRulesForNetworkPolicy(np networkingv1.NetworkPolicy) []string {
+func (fr *FirewallResources) ingressRulesForNetworkPolicy(np networkingv1.NetworkPolicy, fam Family) []Rule {
 	ingress := np.Spec.Ingress
 	if ingress == nil {
 		return nil
 	}
-	if np.ObjectMeta.Namespace != "" {
+	scope, pods, err := fr.podSelectorMatch(np, fam, Destination)
+	if err != nil {
+		fr.logger.Warnw("skipping network policy", "namespace", np.ObjectMeta.Namespace, "name", np.ObjectMeta.Name, "error", err)
+		fr.reject("NetworkPolicy", np.ObjectMeta, err.Error())
 		return nil
 	}
-	rules := []string{}
-	for _, i := range ingress {
-		allow := []string{}
-		except := []string{}
-		for _, f := range i.From {
-			allow = append(allow, f.IPBlock.CIDR)
-			except = append(except, f.IPBlock.Except...)
-		}
-		common := []string{}
-		if len(except) > 0 {
-			common = append(common, fmt.Sprintf("ip saddr != { %s }", strings.Join(except, ", ")))
-		}
-		if len(allow) > 0 {
-			common = append(common, fmt.Sprintf("ip saddr { %s }", strings.Join(allow, ", ")))
-		}
-		tcpPorts := []string{}
-		udpPorts := []string{}
-		for _, p := range i.Ports {
-			proto := proto(p.Protocol)
-			if proto == "tcp" {
-				tcpPorts = append(tcpPorts, fmt.Sprint(p.Port))
-			} else if proto == "udp" {
-				udpPorts = append(udpPorts, fmt.Sprint(p.Port))
-			}
-		}
-		comment := fmt.Sprintf("accept traffic for k8s network policy %s", np.ObjectMeta.Name)
-		if len(tcpPorts) > 0 {
-			rules = append(rules, assembleDestinationPortRule(common, "tcp", tcpPorts, comment+" tcp"))
-		}
-		if len(udpPorts) > 0 {
-			rules = append(rules, assembleDestinationPortRule(common, "udp", udpPorts, comment+" udp"))
-		}
+	rules := []Rule{}
+	for k, i := range ingress {
+		comment := fmt.Sprintf("accept traffic for k8s network policy %s/%s", np.ObjectMeta.Namespace, np.ObjectMeta.Name)
+		rules = append(rules, fr.networkPolicyRules(np, fam, fmt.Sprintf("ingress/%d", k), scope, pods, Source, i.From, i.Ports, comment)...)
 	}
 	return rules
 }
 
-func ingressRulesForService(svc corev1.Service) []string {
-	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer && svc.Spec.Type != corev1.ServiceTypeNodePort {
+func (fr *FirewallResources) egressRulesForNetworkPolicy(np networkingv1.NetworkPolicy, fam Family) []Rule {
+	egress := np.Spec.Egress
+	if egress == nil {
 		return nil
 	}
+	scope, pods, err := fr.podSelectorMatch(np, fam, Source)
+	if err != nil {
+		fr.logger.Warnw("skipping network policy", "namespace", np.ObjectMeta.Namespace, "name", np.ObjectMeta.Name, "error", err)
+		fr.reject("NetworkPolicy", np.ObjectMeta, err.Error())
+		return nil
+	}
+	rules := []Rule{}
+	for k, e := range egress {
+		comment := fmt.Sprintf("accept traffic for np %s/%s", np.ObjectMeta.Namespace, np.ObjectMeta.Name)
+		rules = append(rules, fr.networkPolicyRules(np, fam, fmt.Sprintf("egress/%d", k), scope, pods, Destination, e.To, e.Ports, comment)...)
+	}
+	return rules
+}
+
+// networkPolicyRules assembles the rules for a single ingress or egress rule of a network policy, the peers
+// are matched against the given address selector (saddr or daddr) and every rule is limited to the scope
+// of the pods the policy applies to.
+// Following the semantics of network policies, an empty list of peers allows all addresses and an empty list
+// of ports allows all ports and protocols. Peers with pod or namespace selectors are matched against a named set
+// that holds the addresses of the selected pods.
+// Named ports are resolved against the pods the traffic is sent to, which are the pods of the scope for ingress
+// rules and the selected peer pods for egress rules.
+func (fr *FirewallResources) networkPolicyRules(np networkingv1.NetworkPolicy, fam Family, purpose string, scope AddressMatch, scopePods []corev1.Pod, direction Direction, peers []networkingv1.NetworkPolicyPeer, npPorts []networkingv1.NetworkPolicyPort, comment string) []Rule {
 	allow := []string{}
-	if len(svc.Spec.LoadBalancerSourceRanges) == 0 {
-		allow = append(allow, "0.0.0.0/0")
+	excepting := []networkingv1.IPBlock{}
+	selected := []corev1.Pod{}
+	hasSelectors := false
+	for _, p := range peers {
+		if p.IPBlock != nil {
+			// the exceptions only apply to the cidr of their own peer
+			if len(fam.filter(p.IPBlock.Except)) > 0 {
+				excepting = append(excepting, *p.IPBlock)
+				continue
+			}
+			allow = append(allow, p.IPBlock.CIDR)
+			continue
+		}
+		pods, err := fr.selectPeerPods(np, p)
+		if err != nil {
+			fr.logger.Warnw("skipping peer of network policy", "namespace", np.ObjectMeta.Namespace, "name", np.ObjectMeta.Name, "error", err)
+			fr.leaveOut("NetworkPolicy", np.ObjectMeta, fmt.Sprintf("peer: %s", err))
+			continue
+		}
+		hasSelectors = true
+		selected = append(selected, pods...)
+	}
+	allow = fam.filter(allow)
+
+	scopeDestinations := destinations{description: "the selected pods", pods: scopePods, known: true}
+	ipBlockDestinations, selectedDestinations, allDestinations := scopeDestinations, scopeDestinations, scopeDestinations
+	if direction == Destination {
+		ipBlockDestinations = destinations{description: "ip block peers"}
+		selectedDestinations = destinations{description: "the selected peer pods", pods: selected, known: true}
+		allDestinations = destinations{description: "all destinations"}
 	}
-	allow = append(allow, svc.Spec.LoadBalancerSourceRanges...)
-	common := []string{}
+
+	// peers are combined with a logical or, so ip blocks and selected pods are matched in separate rules
+	type peerMatch struct {
+		matches      []AddressMatch
+		destinations destinations
+	}
+	matches := []peerMatch{}
 	if len(allow) > 0 {
-		common = append(common, fmt.Sprintf("ip saddr { %s }", strings.Join(allow, ", ")))
-	}
-	ips := []string{}
-	if svc.Spec.LoadBalancerIP != "" {
-		ips = append(ips, svc.Spec.LoadBalancerIP)
-	}
-	for _, e := range svc.Status.LoadBalancer.Ingress {
-		ips = append(ips, e.IP)
-	}
-	common = append(common, fmt.Sprintf("ip daddr { %s }", strings.Join(ips, ", ")))
-	tcpPorts := []string{}
-	udpPorts := []string{}
-	for _, p := range svc.Spec.Ports {
-		proto := proto(&p.Protocol)
-		if proto == "tcp" {
-			tcpPorts = append(tcpPorts, fmt.Sprint(p.Port))
-		} else if proto == "udp" {
-			udpPorts = append(udpPorts, fmt.Sprint(p.Port))
+		matches = append(matches, peerMatch{matches: []AddressMatch{scope, {Direction: direction, Addresses: allow}}, destinations: ipBlockDestinations})
+	}
+	for _, b := range excepting {
+		cidr := fam.filter([]string{b.CIDR})
+		if len(cidr) == 0 {
+			continue
 		}
+		common := []AddressMatch{scope, {Direction: direction, Addresses: fam.filter(b.Except), Negated: true}, {Direction: direction, Addresses: cidr}}
+		matches = append(matches, peerMatch{matches: common, destinations: ipBlockDestinations})
 	}
-	comment := fmt.Sprintf("accept traffic for k8s service %s/%s", svc.ObjectMeta.Namespace, svc.ObjectMeta.Name)
-	rules := []string{}
-	if len(tcpPorts) > 0 {
-		rules = append(rules, assembleDestinationPortRule(common, "tcp", tcpPorts, comment))
+	if hasSelectors {
+		set := fr.addSet(fam, setName(np, purpose), selected)
+		matches = append(matches, peerMatch{matches: []AddressMatch{scope, {Direction: direction, Set: set}}, destinations: selectedDestinations})
 	}
-	if len(udpPorts) > 0 {
-		rules = append(rules, assembleDestinationPortRule(common, "udp", udpPorts, comment))
+	if len(peers) == 0 {
+		matches = append(matches, peerMatch{matches: []AddressMatch{scope}, destinations: allDestinations})
 	}
-	return rules
-}
 
-func egressRulesForNetworkPolicy(np networkingv1.NetworkPolicy) []string {
-	egress := np.Spec.Egress
-	if egress == nil {
-		return nil
+	origin := Origin{Kind: "NetworkPolicy", Namespace: np.ObjectMeta.Namespace, Name: np.ObjectMeta.Name}
+	rules := []Rule{}
+	if len(npPorts) == 0 {
+		for _, m := range matches {
+			rules = append(rules, newRule(fam, m.matches, comment, origin))
+		}
+		return rules
 	}
-	rules := []string{}
-	for _, e := range egress {
-		tcpPorts := []string{}
-		udpPorts := []string{}
-		for _, p := range e.Ports {
-			proto := proto(p.Protocol)
-			if proto == "tcp" {
-				tcpPorts = append(tcpPorts, fmt.Sprint(p.Port))
-			} else if proto == "udp" {
-				udpPorts = append(udpPorts, fmt.Sprint(p.Port))
+	for _, m := range matches {
+		ports := fr.destinationPorts(np, npPorts, m.destinations)
+		for _, proto := range protocols {
+			ps, ok := ports[proto]
+			if !ok {
+				continue
 			}
-		}
-		allow := []string{}
-		except := []string{}
-		for _, t := range e.To {
-			if t.IPBlock == nil {
+			rule := newRule(fam, m.matches, comment+" "+proto, origin)
+			if ps.all {
+				rules = append(rules, rule.withProtocols([]string{proto}))
 				continue
 			}
-			allow = append(allow, t.IPBlock.CIDR)
-			except = append(except, t.IPBlock.Except...)
-		}
-		common := []string{}
-		if len(except) > 0 {
-			common = append(common, fmt.Sprintf("ip daddr != { %s }", strings.Join(except, ", ")))
-		}
-		if len(allow) > 0 {
-			common = append(common, fmt.Sprintf("ip daddr { %s }", strings.Join(allow, ", ")))
-		}
-		comment := fmt.Sprintf("accept traffic for np %s", np.ObjectMeta.Name)
-		if len(tcpPorts) > 0 {
-			rules = append(rules, assembleDestinationPortRule(common, "tcp", tcpPorts, comment+" tcp"))
-		}
-		if len(udpPorts) > 0 {
-			rules = append(rules, assembleDestinationPortRule(common, "udp", udpPorts, comment+" udp"))
+			rules = append(rules, rule.withPorts(proto, ps.ports))
 		}
 	}
 	return rules
 }
 
-func assembleDestinationPortRule(common []string, protocol string, ports []string, comment string) string {
-	parts := common
-	parts = append(parts, fmt.Sprintf("%s dport { %s }", protocol, strings.Join(ports, ", ")))
-	parts = append(parts, "counter")
-	parts = append(parts, "accept")
-	if comment != "" {
-		parts = append(parts, "comment", fmt.Sprintf(`"%s"`, comment))
-	}
-	return strings.Join(parts, " ")
-}
-
 func proto(p *corev1.Protocol) string {
 	proto := "tcp"
 	if p != nil {
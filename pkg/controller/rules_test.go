@@ -1,19 +1,31 @@
 package controller
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"path"
 	"testing"
 
 	"io/ioutil"
 	"log"
+	"os"
 
 	"github.com/ghodss/yaml"
 	assert "github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
 	testclient "k8s.io/client-go/kubernetes/fake"
 )
 
+func rule(comment string) Rule {
+	return newRule(FamilyIPv4, []AddressMatch{{Direction: Destination, Addresses: []string{"10.0.0.1"}}}, comment, Origin{})
+}
+
 func TestHasChanged(t *testing.T) {
 	tt := []struct {
 		name string
@@ -36,40 +48,100 @@ func TestHasChanged(t *testing.T) {
 		{
 			name: "changes of rules",
 			old: &FirewallRules{
-				IngressRules: []string{"allow ingress 1"},
+				IngressRules: []Rule{rule("allow ingress 1")},
 			},
 			new: &FirewallRules{
-				IngressRules: []string{"allow ingress 2"},
+				IngressRules: []Rule{rule("allow ingress 2")},
 			},
 			want: true,
 		},
 		{
 			name: "equal rules",
 			old: &FirewallRules{
-				IngressRules: []string{"allow ingress 1", "allow ingress 2"},
+				IngressRules: []Rule{rule("allow ingress 1"), rule("allow ingress 2")},
+			},
+			new: &FirewallRules{
+				IngressRules: []Rule{rule("allow ingress 1"), rule("allow ingress 2")},
+			},
+			want: false,
+		},
+		{
+			name: "equal rules of different origin",
+			old: &FirewallRules{
+				IngressRules: []Rule{newRule(FamilyIPv4, nil, "allow", Origin{Kind: "Service", Name: "a"})},
 			},
 			new: &FirewallRules{
-				IngressRules: []string{"allow ingress 1", "allow ingress 2"},
+				IngressRules: []Rule{newRule(FamilyIPv4, nil, "allow", Origin{Kind: "Service", Name: "b"})},
 			},
 			want: false,
 		},
+		{
+			name: "changes of ports",
+			old: &FirewallRules{
+				EgressRules: []Rule{rule("allow egress").withPorts("tcp", []string{"80"})},
+			},
+			new: &FirewallRules{
+				EgressRules: []Rule{rule("allow egress").withPorts("tcp", []string{"443"})},
+			},
+			want: true,
+		},
+		{
+			name: "changes of family",
+			old: &FirewallRules{
+				EgressRules: []Rule{newRule(FamilyIPv4, nil, "allow", Origin{})},
+			},
+			new: &FirewallRules{
+				EgressRules: []Rule{newRule(FamilyIPv6, nil, "allow", Origin{})},
+			},
+			want: true,
+		},
+		{
+			name: "changes of set elements",
+			old: &FirewallRules{
+				Sets: []Set{{Family: FamilyIPv4, Name: "np_1", Elements: []string{"10.0.0.1"}}},
+			},
+			new: &FirewallRules{
+				Sets: []Set{{Family: FamilyIPv4, Name: "np_1", Elements: []string{"10.0.0.2"}}},
+			},
+			want: true,
+		},
+		{
+			name: "changes of verdict map elements",
+			old: &FirewallRules{
+				Maps: []VerdictMap{{Family: FamilyIPv4, Name: "services_tcp_restricted", Elements: []string{"10.0.0.1 . 443 : jump svc_1"}}},
+			},
+			new: &FirewallRules{
+				Maps: []VerdictMap{{Family: FamilyIPv4, Name: "services_tcp_restricted", Elements: []string{"10.0.0.1 . 443 : jump svc_2"}}},
+			},
+			want: true,
+		},
+		{
+			name: "changes of chain rules",
+			old: &FirewallRules{
+				Chains: []Chain{{Family: FamilyIPv4, Name: "svc_1", Rules: []Rule{rule("allow 1")}}},
+			},
+			new: &FirewallRules{
+				Chains: []Chain{{Family: FamilyIPv4, Name: "svc_1", Rules: []Rule{rule("allow 2")}}},
+			},
+			want: true,
+		},
 		{
 			name: "rule deletion",
 			old: &FirewallRules{
-				IngressRules: []string{"allow ingress 1"},
+				IngressRules: []Rule{rule("allow ingress 1")},
 			},
 			new: &FirewallRules{
-				IngressRules: []string{},
+				IngressRules: []Rule{},
 			},
 			want: true,
 		},
 		{
 			name: "rule addition",
 			old: &FirewallRules{
-				IngressRules: []string{},
+				IngressRules: []Rule{},
 			},
 			new: &FirewallRules{
-				IngressRules: []string{"allow ingress 1"},
+				IngressRules: []Rule{rule("allow ingress 1")},
 			},
 			want: true,
 		},
@@ -80,6 +152,9 @@ func TestHasChanged(t *testing.T) {
 			if got != tc.want {
 				t.Errorf("got: %v, wanted: %v, old: %v, new: %v", got, tc.want, tc.old, tc.new)
 			}
+			if tc.old != nil && (tc.new.Hash() != tc.old.Hash()) != tc.want {
+				t.Errorf("hashes differ: %v, wanted: %v, old: %v, new: %v", tc.new.Hash() != tc.old.Hash(), tc.want, tc.old, tc.new)
+			}
 		})
 	}
 }
@@ -92,16 +167,45 @@ func TestFetchAndAssembleWithTestData(t *testing.T) {
 			for _, i := range list(path.Join(tcd, "services"), false) {
 				var svc corev1.Service
 				mustUnmarshal(path.Join(tcd, "services", i), &svc)
-				_, err := c.CoreV1().Services(svc.ObjectMeta.Namespace).Create(&svc)
+				_, err := c.CoreV1().Services(svc.ObjectMeta.Namespace).Create(context.Background(), &svc, metav1.CreateOptions{})
 				assert.Nil(t, err)
 			}
 			for _, i := range list(path.Join(tcd, "policies"), false) {
 				var np networkingv1.NetworkPolicy
 				mustUnmarshal(path.Join(tcd, "policies", i), &np)
-				_, err := c.NetworkingV1().NetworkPolicies(np.ObjectMeta.Namespace).Create(&np)
+				_, err := c.NetworkingV1().NetworkPolicies(np.ObjectMeta.Namespace).Create(context.Background(), &np, metav1.CreateOptions{})
+				assert.Nil(t, err)
+			}
+			for _, i := range list(path.Join(tcd, "pods"), false) {
+				var pod corev1.Pod
+				mustUnmarshal(path.Join(tcd, "pods", i), &pod)
+				_, err := c.CoreV1().Pods(pod.ObjectMeta.Namespace).Create(context.Background(), &pod, metav1.CreateOptions{})
+				assert.Nil(t, err)
+			}
+			for _, i := range list(path.Join(tcd, "namespaces"), false) {
+				var ns corev1.Namespace
+				mustUnmarshal(path.Join(tcd, "namespaces", i), &ns)
+				_, err := c.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+				assert.Nil(t, err)
+			}
+			for _, i := range list(path.Join(tcd, "nodes"), false) {
+				var n corev1.Node
+				mustUnmarshal(path.Join(tcd, "nodes", i), &n)
+				_, err := c.CoreV1().Nodes().Create(context.Background(), &n, metav1.CreateOptions{})
 				assert.Nil(t, err)
 			}
-			controller := NewFirewallController(c, nil)
+			factory := informers.NewSharedInformerFactory(c, 0)
+			controller := NewFirewallController(factory, zap.NewNop().Sugar(), testConfig(tcd))
+			stop := make(chan struct{})
+			defer close(stop)
+			factory.Start(stop)
+			factory.WaitForCacheSync(stop)
+			// host names are resolved in the background by the first fetch
+			_, err := controller.FetchAndAssemble()
+			if err != nil {
+				panic(err)
+			}
+			controller.resolver.wait()
 			rules, err := controller.FetchAndAssemble()
 			if err != nil {
 				panic(err)
@@ -110,12 +214,64 @@ func TestFetchAndAssembleWithTestData(t *testing.T) {
 			rs, err := rules.Render()
 			assert.Nil(t, err)
 			assert.Equal(t, string(exp), rs)
+			exp, _ = ioutil.ReadFile(path.Join(tcd, "expected.nftablev6"))
+			rs, err = rules.RenderV6()
+			assert.Nil(t, err)
+			assert.Equal(t, string(exp), rs)
 		})
 	}
 }
 
+// testConfig reads the controller config of a test case from its optional config.yaml
+func testConfig(dir string) Config {
+	var tc struct {
+		AllPolicyNamespaces     bool                `json:"allPolicyNamespaces"`
+		PolicyNamespaces        []string            `json:"policyNamespaces"`
+		PolicyNamespaceSelector string              `json:"policyNamespaceSelector"`
+		Hosts                   map[string][]string `json:"hosts"`
+		RenderMode              string              `json:"renderMode"`
+		ObjectCounters          bool                `json:"objectCounters"`
+	}
+	if _, err := os.Stat(path.Join(dir, "config.yaml")); err == nil {
+		mustUnmarshal(path.Join(dir, "config.yaml"), &tc)
+	}
+	c := Config{
+		AllPolicyNamespaces: tc.AllPolicyNamespaces,
+		PolicyNamespaces:    tc.PolicyNamespaces,
+		Resolver:            staticResolver(tc.Hosts),
+		RenderMode:          RenderMode(tc.RenderMode),
+		ObjectCounters:      tc.ObjectCounters,
+	}
+	if tc.PolicyNamespaceSelector != "" {
+		s, err := labels.Parse(tc.PolicyNamespaceSelector)
+		if err != nil {
+			panic(err)
+		}
+		c.PolicyNamespaceSelector = s
+	}
+	return c
+}
+
+// staticResolver resolves host names to fixed addresses
+type staticResolver map[string][]string
+
+func (r staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r[host]
+	if !ok {
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	addrs := []net.IPAddr{}
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
 func list(path string, dirs bool) []string {
 	files, err := ioutil.ReadDir(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// exposedServices returns the valid services of type LoadBalancer and NodePort and the services with external
+// addresses that are reachable on at least one address.
+func (fr *FirewallResources) exposedServices() []corev1.Service {
+	r := []corev1.Service{}
+	for _, svc := range fr.ServiceList.Items {
+		if svc.Spec.Type != corev1.ServiceTypeLoadBalancer && svc.Spec.Type != corev1.ServiceTypeNodePort && len(svc.Spec.ExternalIPs) == 0 {
+			continue
+		}
+		if err := validateService(svc); err != nil {
+			fr.logger.Errorw("rejecting invalid service", "namespace", svc.ObjectMeta.Namespace, "name", svc.ObjectMeta.Name, "error", err)
+			fr.reject("Service", svc.ObjectMeta, err.Error())
+			continue
+		}
+		if len(fr.serviceIPs(svc)) == 0 && (!hasNodePorts(svc) || len(fr.nodeIPs()) == 0) {
+			fr.logger.Infow("skipping service without reachable address", "namespace", svc.ObjectMeta.Namespace, "name", svc.ObjectMeta.Name, "type", svc.Spec.Type)
+			continue
+		}
+		fr.enforce("Service", svc.ObjectMeta)
+		r = append(r, svc)
+	}
+	return r
+}
+
+// ingressRulesForService assembles the rules that accept traffic towards the external and load balancer addresses
+// of the service and towards its node ports on the addresses of the nodes.
+func (fr *FirewallResources) ingressRulesForService(svc corev1.Service, fam Family) []Rule {
+	allow := serviceSources(svc, fam)
+	if len(allow) == 0 {
+		return nil
+	}
+	saddr := AddressMatch{Direction: Source, Addresses: allow}
+	origin := Origin{Kind: "Service", Namespace: svc.ObjectMeta.Namespace, Name: svc.ObjectMeta.Name}
+	rules := []Rule{}
+
+	ips := fam.filter(fr.serviceIPs(svc))
+	if len(ips) > 0 {
+		common := []AddressMatch{saddr, {Direction: Destination, Addresses: ips}}
+		ports := fr.servicePorts(svc)
+		comment := fmt.Sprintf("accept traffic for k8s service %s/%s", svc.ObjectMeta.Namespace, svc.ObjectMeta.Name)
+		for _, proto := range protocols {
+			if len(ports[proto]) > 0 {
+				rules = append(rules, newRule(fam, common, comment, origin).withPorts(proto, ports[proto]))
+			}
+		}
+		l4protos := fr.serviceProtocols(svc, fam)
+		if len(l4protos) > 0 {
+			rules = append(rules, newRule(fam, common, comment, origin).withProtocols(l4protos))
+		}
+	}
+
+	nodeIPs := fam.filter(fr.nodeIPs())
+	if hasNodePorts(svc) && len(nodeIPs) > 0 {
+		common := []AddressMatch{saddr, {Direction: Destination, Addresses: nodeIPs}}
+		ports := nodePorts(svc)
+		comment := fmt.Sprintf("accept node port traffic for k8s service %s/%s", svc.ObjectMeta.Namespace, svc.ObjectMeta.Name)
+		for _, proto := range protocols {
+			if len(ports[proto]) > 0 {
+				rules = append(rules, newRule(fam, common, comment, origin).withPorts(proto, ports[proto]))
+			}
+		}
+	}
+	return rules
+}
+
+// serviceIPs returns the external addresses of a service and the load balancer addresses of a service of type
+// LoadBalancer, including the resolved addresses of load balancer host names.
+func (fr *FirewallResources) serviceIPs(svc corev1.Service) []string {
+	ips := []string{}
+	ips = append(ips, svc.Spec.ExternalIPs...)
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return unique(ips)
+	}
+	if svc.Spec.LoadBalancerIP != "" {
+		ips = append(ips, svc.Spec.LoadBalancerIP)
+	}
+	for _, e := range svc.Status.LoadBalancer.Ingress {
+		if e.IP != "" {
+			ips = append(ips, e.IP)
+		}
+		if e.Hostname != "" {
+			ips = append(ips, fr.HostIPs[e.Hostname]...)
+		}
+	}
+	return unique(ips)
+}
+
+// serviceSources returns the networks of the family that are allowed to access a service, which are all
+// addresses if the service has no load balancer source ranges.
+func serviceSources(svc corev1.Service, fam Family) []string {
+	if len(svc.Spec.LoadBalancerSourceRanges) == 0 {
+		return []string{fam.all()}
+	}
+	return fam.filter(svc.Spec.LoadBalancerSourceRanges)
+}
+
+// servicePorts returns the ports of a service by protocol, ports with unsupported protocols are reported and left out.
+func (fr *FirewallResources) servicePorts(svc corev1.Service) map[string][]string {
+	ports := map[string][]string{}
+	for _, p := range svc.Spec.Ports {
+		proto := proto(&p.Protocol)
+		if !isPortProtocol(proto) {
+			fr.logger.Warnw("skipping port of service with unsupported protocol", "namespace", svc.ObjectMeta.Namespace, "name", svc.ObjectMeta.Name, "port", p.Port, "protocol", p.Protocol)
+			fr.leaveOut("Service", svc.ObjectMeta, fmt.Sprintf("port %d: unsupported protocol %s", p.Port, p.Protocol))
+			continue
+		}
+		ports[proto] = append(ports[proto], fmt.Sprint(p.Port))
+	}
+	return ports
+}
+
+// nodePorts returns the node ports of a service by protocol.
+func nodePorts(svc corev1.Service) map[string][]string {
+	ports := map[string][]string{}
+	for _, p := range svc.Spec.Ports {
+		proto := proto(&p.Protocol)
+		if p.NodePort == 0 || !isPortProtocol(proto) {
+			continue
+		}
+		ports[proto] = append(ports[proto], fmt.Sprint(p.NodePort))
+	}
+	return ports
+}
+
+func hasNodePorts(svc corev1.Service) bool {
+	for _, p := range svc.Spec.Ports {
+		if p.NodePort != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeIPs returns the internal addresses of all nodes.
+func (fr *FirewallResources) nodeIPs() []string {
+	ips := []string{}
+	if fr.NodeList == nil {
+		return ips
+	}
+	for _, n := range fr.NodeList.Items {
+		for _, a := range n.Status.Addresses {
+			if a.Type == corev1.NodeInternalIP {
+				ips = append(ips, a.Address)
+			}
+		}
+	}
+	return uniqueSorted(ips)
+}
@@ -0,0 +1,137 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Set is a named nftables set of addresses that is referenced by rules, its elements are kept up to date
+// with the pods that are selected by a network policy.
+// Sets with ports hold concatenations of addresses and ports like "10.0.0.1 . 443".
+type Set struct {
+	Family   Family
+	Name     string
+	Ports    bool
+	Elements []string
+}
+
+// Type returns the nftables data type of the elements of the set.
+func (s Set) Type() string {
+	if s.Ports {
+		return s.Family.addressType() + " . inet_service"
+	}
+	return s.Family.addressType()
+}
+
+// setName returns a stable name for the set of a network policy rule that fits into the nftables limits.
+func setName(np networkingv1.NetworkPolicy, purpose string) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%s", np.ObjectMeta.Namespace, np.ObjectMeta.Name, purpose)))
+	return fmt.Sprintf("np_%x", h[:8])
+}
+
+// addSet adds a set with the addresses of the pods of the family and returns its name.
+func (fr *FirewallResources) addSet(fam Family, name string, pods []corev1.Pod) string {
+	if fr.sets == nil {
+		fr.sets = map[Family]map[string]Set{}
+	}
+	if fr.sets[fam] == nil {
+		fr.sets[fam] = map[string]Set{}
+	}
+	elements := []string{}
+	for _, p := range pods {
+		elements = append(elements, fam.filter(podIPs(p))...)
+	}
+	fr.sets[fam][name] = Set{
+		Family:   fam,
+		Name:     name,
+		Elements: uniqueSorted(elements),
+	}
+	return name
+}
+
+// setsOf returns the sets of the family sorted by name.
+func (fr *FirewallResources) setsOf(fam Family) []Set {
+	r := []Set{}
+	for _, s := range fr.sets[fam] {
+		r = append(r, s)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r
+}
+
+// podSelectorMatch returns the match and the pods a network policy applies to, which are the pods of the policy's
+// namespace that are selected by its pod selector. The addresses of these pods are kept in a named set.
+func (fr *FirewallResources) podSelectorMatch(np networkingv1.NetworkPolicy, fam Family, direction Direction) (AddressMatch, []corev1.Pod, error) {
+	podSelector, err := metav1.LabelSelectorAsSelector(&np.Spec.PodSelector)
+	if err != nil {
+		return AddressMatch{}, nil, fmt.Errorf("invalid pod selector: %w", err)
+	}
+	pods := fr.selectPods(map[string]bool{np.ObjectMeta.Namespace: true}, podSelector)
+	set := fr.addSet(fam, setName(np, "pods"), pods)
+	return AddressMatch{Direction: direction, Set: set}, pods, nil
+}
+
+// selectPeerPods returns the pods that are selected by the pod and namespace selectors of a network policy peer.
+func (fr *FirewallResources) selectPeerPods(np networkingv1.NetworkPolicy, peer networkingv1.NetworkPolicyPeer) ([]corev1.Pod, error) {
+	podSelector := labels.Everything()
+	if peer.PodSelector != nil {
+		s, err := metav1.LabelSelectorAsSelector(peer.PodSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pod selector: %w", err)
+		}
+		podSelector = s
+	}
+	namespaces := map[string]bool{np.ObjectMeta.Namespace: true}
+	if peer.NamespaceSelector != nil {
+		nsSelector, err := metav1.LabelSelectorAsSelector(peer.NamespaceSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespace selector: %w", err)
+		}
+		namespaces = map[string]bool{}
+		if fr.NamespaceList != nil {
+			for _, ns := range fr.NamespaceList.Items {
+				if nsSelector.Matches(labels.Set(ns.ObjectMeta.Labels)) {
+					namespaces[ns.ObjectMeta.Name] = true
+				}
+			}
+		}
+	}
+	return fr.selectPods(namespaces, podSelector), nil
+}
+
+// selectPods returns the pods with addresses in the given namespaces that match the selector.
+func (fr *FirewallResources) selectPods(namespaces map[string]bool, selector labels.Selector) []corev1.Pod {
+	r := []corev1.Pod{}
+	if fr.PodList == nil {
+		return r
+	}
+	for _, p := range fr.PodList.Items {
+		if !namespaces[p.ObjectMeta.Namespace] || p.Spec.HostNetwork {
+			continue
+		}
+		if p.Status.Phase == corev1.PodSucceeded || p.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		if selector.Matches(labels.Set(p.ObjectMeta.Labels)) {
+			r = append(r, p)
+		}
+	}
+	return r
+}
+
+func podIPs(p corev1.Pod) []string {
+	r := []string{}
+	for _, ip := range p.Status.PodIPs {
+		r = append(r, ip.IP)
+	}
+	if len(r) == 0 && p.Status.PodIP != "" {
+		r = append(r, p.Status.PodIP)
+	}
+	return r
+}
@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EnforcementState is the result of turning a Service or NetworkPolicy into rules.
+type EnforcementState string
+
+const (
+	// EnforcementEnforced means that all values of the object are enforced.
+	EnforcementEnforced EnforcementState = "enforced"
+	// EnforcementPartial means that the object is enforced, but unsupported values are left out.
+	EnforcementPartial EnforcementState = "partial"
+	// EnforcementRejected means that no rules are enforced for the object.
+	EnforcementRejected EnforcementState = "rejected"
+)
+
+// ObjectStatus is the enforcement status of a Service or NetworkPolicy.
+type ObjectStatus struct {
+	Origin
+	State EnforcementState
+	// Unsupported lists the values that were left out of a partially enforced object
+	Unsupported []string
+	// Reason describes why the object was rejected
+	Reason string
+}
+
+// enforce records that the object is enforced unless a status was recorded for it already.
+func (fr *FirewallResources) enforce(kind string, meta metav1.ObjectMeta) {
+	fr.status(kind, meta)
+}
+
+// reject records that the object is rejected.
+func (fr *FirewallResources) reject(kind string, meta metav1.ObjectMeta, reason string) {
+	s := fr.status(kind, meta)
+	s.State = EnforcementRejected
+	s.Reason = reason
+	s.Unsupported = nil
+}
+
+// leaveOut records that an unsupported value of the object is left out, which makes an enforced object
+// partially enforced.
+func (fr *FirewallResources) leaveOut(kind string, meta metav1.ObjectMeta, value string) {
+	s := fr.status(kind, meta)
+	if s.State == EnforcementRejected {
+		return
+	}
+	s.State = EnforcementPartial
+	for _, u := range s.Unsupported {
+		if u == value {
+			return
+		}
+	}
+	s.Unsupported = append(s.Unsupported, value)
+}
+
+func (fr *FirewallResources) status(kind string, meta metav1.ObjectMeta) *ObjectStatus {
+	if fr.statuses == nil {
+		fr.statuses = map[Origin]*ObjectStatus{}
+	}
+	o := Origin{Kind: kind, Namespace: meta.Namespace, Name: meta.Name}
+	s, ok := fr.statuses[o]
+	if !ok {
+		s = &ObjectStatus{Origin: o, State: EnforcementEnforced}
+		fr.statuses[o] = s
+	}
+	return s
+}
+
+// objectStatuses returns the recorded statuses ordered by kind, namespace and name.
+func (fr *FirewallResources) objectStatuses() []ObjectStatus {
+	r := []ObjectStatus{}
+	for _, s := range fr.statuses {
+		r = append(r, *s)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Kind != r[j].Kind {
+			return r[i].Kind < r[j].Kind
+		}
+		if r[i].Namespace != r[j].Namespace {
+			return r[i].Namespace < r[j].Namespace
+		}
+		return r[i].Name < r[j].Name
+	})
+	return r
+}
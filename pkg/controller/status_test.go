@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestObjectStatuses(t *testing.T) {
+	lb := func(name string, annotations map[string]string, sourceRanges ...string) corev1.Service {
+		return corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Annotations: annotations},
+			Spec: corev1.ServiceSpec{
+				Type:                     corev1.ServiceTypeLoadBalancer,
+				LoadBalancerSourceRanges: sourceRanges,
+				Ports:                    []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 443}},
+			},
+			Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{{IP: "185.1.2.3"}}}},
+		}
+	}
+	np := func(namespace, name string, port intstr.IntOrString) networkingv1.NetworkPolicy {
+		return networkingv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Spec: networkingv1.NetworkPolicySpec{
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+				Egress: []networkingv1.NetworkPolicyEgressRule{{
+					To:    []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "0.0.0.0/0"}}},
+					Ports: []networkingv1.NetworkPolicyPort{{Port: &port}},
+				}},
+			},
+		}
+	}
+	fr := &FirewallResources{
+		ServiceList: &corev1.ServiceList{Items: []corev1.Service{
+			lb("enforced", nil),
+			lb("partial", map[string]string{annotationProtocols: "gre, foo"}),
+			lb("rejected", nil, "10.0.0.0/33"),
+		}},
+		NetworkPolicyList: &networkingv1.NetworkPolicyList{Items: []networkingv1.NetworkPolicy{
+			np("default", "enforced", intstr.FromInt(53)),
+			np("default", "partial", intstr.FromString("dns")),
+			np("kube-system", "rejected", intstr.FromInt(53)),
+		}},
+		logger: zap.NewNop().Sugar(),
+		config: Config{PolicyNamespaces: []string{"default"}},
+	}
+	rules, err := fr.assembleRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]ObjectStatus{}
+	for _, s := range rules.Statuses {
+		got[s.String()] = s
+	}
+	want := map[string]EnforcementState{
+		"Service default/enforced":           EnforcementEnforced,
+		"Service default/partial":            EnforcementPartial,
+		"Service default/rejected":           EnforcementRejected,
+		"NetworkPolicy default/enforced":     EnforcementEnforced,
+		"NetworkPolicy default/partial":      EnforcementPartial,
+		"NetworkPolicy kube-system/rejected": EnforcementRejected,
+	}
+	if len(got) != len(want) {
+		t.Errorf("got statuses %v, want %v", got, want)
+	}
+	for o, state := range want {
+		if got[o].State != state {
+			t.Errorf("got state %q of %s, want %q", got[o].State, o, state)
+		}
+	}
+	if u := got["Service default/partial"].Unsupported; !reflect.DeepEqual(u, []string{"annotation firewall.metal-stack.io/protocols: unsupported protocol foo"}) {
+		t.Errorf("got unsupported values %v", u)
+	}
+	if u := got["NetworkPolicy default/partial"].Unsupported; !reflect.DeepEqual(u, []string{`port dns: named port "dns" cannot be resolved for ip block peers`}) {
+		t.Errorf("got unsupported values %v", u)
+	}
+	if got["Service default/rejected"].Reason == "" || got["NetworkPolicy kube-system/rejected"].Reason == "" {
+		t.Errorf("rejected objects have no reason")
+	}
+}
+
+func TestNetworkPoliciesWithoutPolicyNamespaces(t *testing.T) {
+	fr := &FirewallResources{
+		ServiceList: &corev1.ServiceList{},
+		NetworkPolicyList: &networkingv1.NetworkPolicyList{Items: []networkingv1.NetworkPolicy{{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "np"},
+			Spec: networkingv1.NetworkPolicySpec{
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+				Egress:      []networkingv1.NetworkPolicyEgressRule{{}},
+			},
+		}}},
+		logger: zap.NewNop().Sugar(),
+	}
+	rules, err := fr.assembleRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules.EgressRules) != 0 {
+		t.Errorf("got egress rules %v without enforced namespaces", rules.EgressRules)
+	}
+	if len(rules.Statuses) != 1 || rules.Statuses[0].State != EnforcementRejected || rules.Statuses[0].Reason != "network policies are not enforced in any namespace" {
+		t.Errorf("got statuses %v, want the rejected policy", rules.Statuses)
+	}
+}
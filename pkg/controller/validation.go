@@ -0,0 +1,203 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// MaxCommentLength is the maximum length of a rule comment that is accepted by nftables, rendered comments are
+// truncated to it and the appliers store comments with at most this length in both modes.
+const MaxCommentLength = 128
+
+// parseAddress parses an address or a network in CIDR notation and returns it in its canonical form
+// together with its family. Host bits of networks are cleared.
+func parseAddress(s string) (string, Family, error) {
+	if strings.Contains(s, "/") {
+		ip, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid network %q", s)
+		}
+		return n.String(), familyOf(ip), nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", "", fmt.Errorf("invalid address %q", s)
+	}
+	return ip.String(), familyOf(ip), nil
+}
+
+func familyOf(ip net.IP) Family {
+	if ip.To4() != nil {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+func validateNetwork(s string) error {
+	if _, _, err := net.ParseCIDR(s); err != nil {
+		return fmt.Errorf("invalid network %q", s)
+	}
+	return nil
+}
+
+func validateIP(s string) error {
+	if net.ParseIP(s) == nil {
+		return fmt.Errorf("invalid address %q", s)
+	}
+	return nil
+}
+
+func validatePort(p int) error {
+	if p < 1 || p > 65535 {
+		return fmt.Errorf("port %d is not in the range 1-65535", p)
+	}
+	return nil
+}
+
+// validateService checks all values of a service that are rendered into rules. A service with an invalid
+// value is rejected as a whole.
+func validateService(svc corev1.Service) error {
+	for _, r := range svc.Spec.LoadBalancerSourceRanges {
+		if err := validateNetwork(r); err != nil {
+			return fmt.Errorf("loadBalancerSourceRanges: %w", err)
+		}
+	}
+	for _, ip := range svc.Spec.ExternalIPs {
+		if err := validateIP(ip); err != nil {
+			return fmt.Errorf("externalIPs: %w", err)
+		}
+	}
+	if svc.Spec.LoadBalancerIP != "" {
+		if err := validateIP(svc.Spec.LoadBalancerIP); err != nil {
+			return fmt.Errorf("loadBalancerIP: %w", err)
+		}
+	}
+	for _, p := range svc.Spec.Ports {
+		if err := validatePort(int(p.Port)); err != nil {
+			return fmt.Errorf("ports: %w", err)
+		}
+		if p.NodePort != 0 {
+			if err := validatePort(int(p.NodePort)); err != nil {
+				return fmt.Errorf("nodePort: %w", err)
+			}
+		}
+	}
+	for _, e := range svc.Status.LoadBalancer.Ingress {
+		if e.IP != "" {
+			if err := validateIP(e.IP); err != nil {
+				return fmt.Errorf("load balancer ingress: %w", err)
+			}
+		}
+		if e.Hostname != "" {
+			if errs := validation.IsDNS1123Subdomain(e.Hostname); len(errs) > 0 {
+				return fmt.Errorf("load balancer ingress: invalid host name %q: %s", e.Hostname, strings.Join(errs, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// validateNetworkPolicy checks all values of a network policy that are rendered into rules. A network policy
+// with an invalid value is rejected as a whole.
+func validateNetworkPolicy(np networkingv1.NetworkPolicy) error {
+	if _, err := metav1.LabelSelectorAsSelector(&np.Spec.PodSelector); err != nil {
+		return fmt.Errorf("podSelector: %w", err)
+	}
+	for _, i := range np.Spec.Ingress {
+		if err := validatePeers(i.From); err != nil {
+			return fmt.Errorf("ingress: %w", err)
+		}
+		if err := validatePorts(i.Ports); err != nil {
+			return fmt.Errorf("ingress: %w", err)
+		}
+	}
+	for _, e := range np.Spec.Egress {
+		if err := validatePeers(e.To); err != nil {
+			return fmt.Errorf("egress: %w", err)
+		}
+		if err := validatePorts(e.Ports); err != nil {
+			return fmt.Errorf("egress: %w", err)
+		}
+	}
+	return nil
+}
+
+func validatePeers(peers []networkingv1.NetworkPolicyPeer) error {
+	for _, p := range peers {
+		if p.IPBlock != nil {
+			if err := validateNetwork(p.IPBlock.CIDR); err != nil {
+				return fmt.Errorf("ipBlock: %w", err)
+			}
+			for _, e := range p.IPBlock.Except {
+				if err := validateNetwork(e); err != nil {
+					return fmt.Errorf("ipBlock except: %w", err)
+				}
+			}
+		}
+		if p.PodSelector != nil {
+			if _, err := metav1.LabelSelectorAsSelector(p.PodSelector); err != nil {
+				return fmt.Errorf("podSelector: %w", err)
+			}
+		}
+		if p.NamespaceSelector != nil {
+			if _, err := metav1.LabelSelectorAsSelector(p.NamespaceSelector); err != nil {
+				return fmt.Errorf("namespaceSelector: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func validatePorts(ports []networkingv1.NetworkPolicyPort) error {
+	for _, p := range ports {
+		if p.Port == nil {
+			if p.EndPort != nil {
+				return fmt.Errorf("endPort %d requires a port", *p.EndPort)
+			}
+			continue
+		}
+		if p.Port.Type == intstr.String {
+			if errs := validation.IsValidPortName(p.Port.StrVal); len(errs) > 0 {
+				return fmt.Errorf("invalid port name %q: %s", p.Port.StrVal, strings.Join(errs, ", "))
+			}
+			if p.EndPort != nil {
+				return fmt.Errorf("endPort %d cannot be combined with named port %q", *p.EndPort, p.Port.StrVal)
+			}
+			continue
+		}
+		if err := validatePort(p.Port.IntValue()); err != nil {
+			return err
+		}
+		if p.EndPort != nil {
+			if err := validatePort(int(*p.EndPort)); err != nil {
+				return fmt.Errorf("endPort: %w", err)
+			}
+			if int(*p.EndPort) < p.Port.IntValue() {
+				return fmt.Errorf("endPort %d must not be lower than port %d", *p.EndPort, p.Port.IntValue())
+			}
+		}
+	}
+	return nil
+}
+
+// escapeComment makes a string safe to be rendered as a quoted nftables comment. nftables knows no escape
+// sequences in quoted strings, so quotes, backslashes and non printable characters are replaced and the
+// comment is truncated to the maximum length.
+func escapeComment(s string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(s) && b.Len() < MaxCommentLength; i++ {
+		c := s[i]
+		if c < ' ' || c > '~' || c == '"' || c == '\\' {
+			c = '_'
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		name      string
+		address   string
+		want      string
+		wantFam   Family
+		wantError bool
+	}{
+		{name: "ipv4 address", address: "10.0.0.1", want: "10.0.0.1", wantFam: FamilyIPv4},
+		{name: "ipv4 network with host bits", address: "10.1.2.3/16", want: "10.1.0.0/16", wantFam: FamilyIPv4},
+		{name: "ipv6 address", address: "2001:DB8::0:1", want: "2001:db8::1", wantFam: FamilyIPv6},
+		{name: "ipv6 network", address: "fd00::/8", want: "fd00::/8", wantFam: FamilyIPv6},
+		{name: "ipv4 mapped ipv6 address", address: "::ffff:10.0.0.1", want: "10.0.0.1", wantFam: FamilyIPv4},
+		{name: "invalid prefix length", address: "10.0.0.0/33", wantError: true},
+		{name: "invalid address", address: "10.0.0.256", wantError: true},
+		{name: "injected rule", address: "0.0.0.0/0 } accept", wantError: true},
+		{name: "empty", address: "", wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, fam, err := parseAddress(tt.address)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("parseAddress() error = %v, wantError %v", err, tt.wantError)
+			}
+			if got != tt.want || fam != tt.wantFam {
+				t.Errorf("parseAddress() = %v %v, want %v %v", got, fam, tt.want, tt.wantFam)
+			}
+		})
+	}
+}
+
+func TestEscapeComment(t *testing.T) {
+	tests := []struct {
+		name    string
+		comment string
+		want    string
+	}{
+		{name: "plain", comment: "accept traffic for k8s service default/web", want: "accept traffic for k8s service default/web"},
+		{name: "quote", comment: `web" accept`, want: "web_ accept"},
+		{name: "backslash", comment: `web\`, want: "web_"},
+		{name: "newline", comment: "web\n}", want: "web_}"},
+		{name: "non ascii", comment: "wäb", want: "w__b"},
+		{name: "too long", comment: strings.Repeat("a", 200), want: strings.Repeat("a", MaxCommentLength)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := escapeComment(tt.comment); got != tt.want {
+				t.Errorf("escapeComment() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
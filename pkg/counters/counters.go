@@ -0,0 +1,211 @@
+// Package counters reads the counters of the rules of the firewall tables and exports them as metrics of the
+// services and network policies the rules were generated for.
+package counters
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/applier"
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+)
+
+// dropComment is the comment of the rule that counts the packets that are dropped by the policy of the chain
+const dropComment = "count dropped packets"
+
+var (
+	objectPacketsDesc = prometheus.NewDesc("firewall_policy_controller_object_packets_total",
+		"Number of packets that matched the firewall rules of a k8s entity.",
+		[]string{"family", "kind", "namespace", "name"}, nil)
+	objectBytesDesc = prometheus.NewDesc("firewall_policy_controller_object_bytes_total",
+		"Number of bytes that matched the firewall rules of a k8s entity.",
+		[]string{"family", "kind", "namespace", "name"}, nil)
+	sharedPacketsDesc = prometheus.NewDesc("firewall_policy_controller_shared_packets_total",
+		"Number of packets that matched firewall rules which were generated for several k8s entities together.",
+		[]string{"family"}, nil)
+	sharedBytesDesc = prometheus.NewDesc("firewall_policy_controller_shared_bytes_total",
+		"Number of bytes that matched firewall rules which were generated for several k8s entities together.",
+		[]string{"family"}, nil)
+	droppedPacketsDesc = prometheus.NewDesc("firewall_policy_controller_dropped_packets_total",
+		"Number of packets that were dropped because no firewall rule accepted them.",
+		[]string{"family"}, nil)
+	droppedBytesDesc = prometheus.NewDesc("firewall_policy_controller_dropped_bytes_total",
+		"Number of bytes that were dropped because no firewall rule accepted them.",
+		[]string{"family"}, nil)
+)
+
+// ruleCounter is the counter of a rule of the firewall tables.
+type ruleCounter struct {
+	applier.RuleHandle
+	comment string
+	packets uint64
+	bytes   uint64
+}
+
+type counts struct {
+	packets uint64
+	bytes   uint64
+}
+
+type objectKey struct {
+	family controller.Family
+	origin controller.Origin
+}
+
+// Exporter periodically reads the counters of the firewall tables and sums them up by the k8s entities the rules
+// were generated for. Rules are mapped to the entities by the handles the applier recorded for them. The rules
+// need to be assembled with controller.Config.ObjectCounters to keep the rules of different entities apart, the
+// traffic of rules that still belong to several entities cannot be told apart by entity and is exported as shared
+// traffic.
+type Exporter struct {
+	logger   *zap.SugaredLogger
+	interval time.Duration
+	handles  func() map[applier.RuleHandle]controller.Rule
+	read     func() ([]ruleCounter, error)
+
+	mu      sync.Mutex
+	objects map[objectKey]counts
+	shared  map[controller.Family]counts
+	dropped map[controller.Family]counts
+}
+
+// NewExporter creates a new Exporter, handles returns the applied rules by their handles.
+func NewExporter(logger *zap.SugaredLogger, interval time.Duration, handles func() map[applier.RuleHandle]controller.Rule) *Exporter {
+	return &Exporter{
+		logger:   logger,
+		interval: interval,
+		handles:  handles,
+		read:     readCounters,
+	}
+}
+
+// Run reads the counters every interval until stop is closed; is blocking.
+func (e *Exporter) Run(stop <-chan struct{}) {
+	t := time.NewTicker(e.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			err := e.update()
+			if err != nil {
+				e.logger.Warnw("unable to read counters of the firewall rules", "error", err)
+			}
+		}
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- objectPacketsDesc
+	ch <- objectBytesDesc
+	ch <- sharedPacketsDesc
+	ch <- sharedBytesDesc
+	ch <- droppedPacketsDesc
+	ch <- droppedBytesDesc
+}
+
+// Collect implements prometheus.Collector, it exports the counters that were read last.
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for k, c := range e.objects {
+		labels := []string{string(k.family), k.origin.Kind, k.origin.Namespace, k.origin.Name}
+		ch <- prometheus.MustNewConstMetric(objectPacketsDesc, prometheus.CounterValue, float64(c.packets), labels...)
+		ch <- prometheus.MustNewConstMetric(objectBytesDesc, prometheus.CounterValue, float64(c.bytes), labels...)
+	}
+	for fam, c := range e.shared {
+		ch <- prometheus.MustNewConstMetric(sharedPacketsDesc, prometheus.CounterValue, float64(c.packets), string(fam))
+		ch <- prometheus.MustNewConstMetric(sharedBytesDesc, prometheus.CounterValue, float64(c.bytes), string(fam))
+	}
+	for fam, c := range e.dropped {
+		ch <- prometheus.MustNewConstMetric(droppedPacketsDesc, prometheus.CounterValue, float64(c.packets), string(fam))
+		ch <- prometheus.MustNewConstMetric(droppedBytesDesc, prometheus.CounterValue, float64(c.bytes), string(fam))
+	}
+}
+
+// update reads the counters and maps them to the k8s entities of the applied rules.
+func (e *Exporter) update() error {
+	handles := e.handles()
+	if handles == nil {
+		return nil
+	}
+	counters, err := e.read()
+	if err != nil {
+		return err
+	}
+	objects := map[objectKey]counts{}
+	shared := map[controller.Family]counts{}
+	dropped := map[controller.Family]counts{}
+	for _, c := range counters {
+		if c.comment == dropComment {
+			dropped[c.Family] = add(dropped[c.Family], c)
+			continue
+		}
+		rule, ok := handles[c.RuleHandle]
+		if !ok {
+			continue
+		}
+		if len(rule.Origins) != 1 {
+			shared[c.Family] = add(shared[c.Family], c)
+			continue
+		}
+		k := objectKey{family: c.Family, origin: rule.Origins[0]}
+		objects[k] = add(objects[k], c)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.objects = objects
+	e.shared = shared
+	e.dropped = dropped
+	return nil
+}
+
+func add(c counts, r ruleCounter) counts {
+	return counts{packets: c.packets + r.packets, bytes: c.bytes + r.bytes}
+}
+
+// readCounters reads the counters of all rules of the firewall tables of both families over netlink.
+func readCounters() ([]ruleCounter, error) {
+	c, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open netlink connection: %w", err)
+	}
+	r := []ruleCounter{}
+	for fam, tf := range map[controller.Family]nftables.TableFamily{controller.FamilyIPv4: nftables.TableFamilyIPv4, controller.FamilyIPv6: nftables.TableFamilyIPv6} {
+		chains, err := c.ListChainsOfTableFamily(tf)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list %s chains: %w", fam, err)
+		}
+		for _, chain := range chains {
+			if chain.Table.Name != controller.TableName {
+				continue
+			}
+			rules, err := c.GetRules(chain.Table, chain)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read rules of %s chain %s: %w", fam, chain.Name, err)
+			}
+			for _, rule := range rules {
+				for _, e := range rule.Exprs {
+					if counter, ok := e.(*expr.Counter); ok {
+						r = append(r, ruleCounter{
+							RuleHandle: applier.RuleHandle{Family: fam, Handle: rule.Handle},
+							comment:    applier.RuleComment(rule.UserData),
+							packets:    counter.Packets,
+							bytes:      counter.Bytes,
+						})
+						break
+					}
+				}
+			}
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,65 @@
+package counters
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/applier"
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+)
+
+func TestExporter(t *testing.T) {
+	svc := controller.Origin{Kind: "Service", Namespace: "default", Name: "lb"}
+	np := controller.Origin{Kind: "NetworkPolicy", Namespace: "default", Name: "np"}
+	other := controller.Origin{Kind: "NetworkPolicy", Namespace: "other", Name: "np"}
+	handle := func(h uint64) applier.RuleHandle {
+		return applier.RuleHandle{Family: controller.FamilyIPv4, Handle: h}
+	}
+	// rules are mapped by their handles, the counters of rules with several origins are shared
+	handles := map[applier.RuleHandle]controller.Rule{
+		handle(5): {Family: controller.FamilyIPv4, Counter: true, Verdict: controller.VerdictAccept, Comment: "accept traffic for k8s service default/lb", Origins: []controller.Origin{svc}},
+		handle(6): {Family: controller.FamilyIPv4, Counter: true, Verdict: controller.VerdictAccept, Comment: "accept traffic for np default/np", Origins: []controller.Origin{np}},
+		handle(7): {Family: controller.FamilyIPv4, Counter: true, Verdict: controller.VerdictAccept, Comment: "accept traffic for np other/np", Origins: []controller.Origin{other}},
+		handle(8): {Family: controller.FamilyIPv4, Counter: true, Verdict: controller.VerdictAccept, Comment: "merged", Origins: []controller.Origin{np, svc}},
+	}
+	e := NewExporter(zap.NewNop().Sugar(), 0, func() map[applier.RuleHandle]controller.Rule { return handles })
+	e.read = func() ([]ruleCounter, error) {
+		return []ruleCounter{
+			{RuleHandle: handle(1), comment: "accept established connections", packets: 1000, bytes: 100000},
+			{RuleHandle: handle(5), comment: "accept traffic for k8s service default/lb", packets: 10, bytes: 1000},
+			{RuleHandle: handle(6), comment: "accept traffic for np default/np", packets: 2, bytes: 200},
+			{RuleHandle: handle(7), comment: "accept traffic for np other/np", packets: 3, bytes: 300},
+			{RuleHandle: handle(8), comment: "merged", packets: 7, bytes: 700},
+			{RuleHandle: handle(9), comment: dropComment, packets: 5, bytes: 300},
+		}, nil
+	}
+	err := e.update()
+	if err != nil {
+		t.Fatalf("update() error = %v", err)
+	}
+	want := `
+# HELP firewall_policy_controller_dropped_packets_total Number of packets that were dropped because no firewall rule accepted them.
+# TYPE firewall_policy_controller_dropped_packets_total counter
+firewall_policy_controller_dropped_packets_total{family="ip"} 5
+# HELP firewall_policy_controller_object_packets_total Number of packets that matched the firewall rules of a k8s entity.
+# TYPE firewall_policy_controller_object_packets_total counter
+firewall_policy_controller_object_packets_total{family="ip",kind="NetworkPolicy",name="np",namespace="default"} 2
+firewall_policy_controller_object_packets_total{family="ip",kind="NetworkPolicy",name="np",namespace="other"} 3
+firewall_policy_controller_object_packets_total{family="ip",kind="Service",name="lb",namespace="default"} 10
+# HELP firewall_policy_controller_shared_packets_total Number of packets that matched firewall rules which were generated for several k8s entities together.
+# TYPE firewall_policy_controller_shared_packets_total counter
+firewall_policy_controller_shared_packets_total{family="ip"} 7
+`
+	err = testutil.CollectAndCompare(e, strings.NewReader(want), "firewall_policy_controller_object_packets_total", "firewall_policy_controller_shared_packets_total", "firewall_policy_controller_dropped_packets_total")
+	if err != nil {
+		t.Error(err)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(e); err != nil {
+		t.Errorf("Register() error = %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package droptailer
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -62,7 +63,7 @@ func (d *DropTailer) WatchServerIP() {
 		LabelSelector: labels.SelectorFromSet(labelMap).String(),
 	}
 	for {
-		watcher, err := d.client.CoreV1().Pods(d.namespace).Watch(opts)
+		watcher, err := d.client.CoreV1().Pods(d.namespace).Watch(context.Background(), opts)
 		if err != nil {
 			d.logger.Errorw("could not watch for pods", "error", err)
 			time.Sleep(10 * time.Second)
@@ -92,7 +93,7 @@ func (d *DropTailer) WatchServerIP() {
 func (d *DropTailer) WatchClientSecret() {
 	keys := []string{secretKeyCaCertificate, secretKeyCertificate, secretKeyCertificateKey}
 	for {
-		s, err := d.client.CoreV1().Secrets(namespace).Watch(metav1.ListOptions{})
+		s, err := d.client.CoreV1().Secrets(namespace).Watch(context.Background(), metav1.ListOptions{})
 		if err != nil {
 			d.logger.Errorw("could not watch for pods droptailer-client secret", "error", err)
 			time.Sleep(10 * time.Second)
@@ -0,0 +1,147 @@
+// Package health reports the liveness and readiness of the controller over http and to the systemd watchdog.
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+	"go.uber.org/zap"
+)
+
+// Config holds the state of the controller the health is derived from.
+type Config struct {
+	// Synced returns whether the initial sync of the informer caches is done
+	Synced func() bool
+	// LastSuccess returns the time the last successful reconciliation finished, in which the rules were applied or
+	// found to be up to date
+	LastSuccess func() time.Time
+	// LastReconcile returns the time the last reconciliation finished
+	LastReconcile func() time.Time
+	// StallTimeout is the time without finished reconciliation after which the controller is considered stalled
+	// and the time without successful reconciliation after which it is not ready anymore, it must be longer than
+	// the heartbeat interval of the reconciler
+	StallTimeout time.Duration
+}
+
+// Checker checks the liveness and readiness of the controller.
+type Checker struct {
+	config  Config
+	logger  *zap.SugaredLogger
+	started time.Time
+	now     func() time.Time
+}
+
+// NewChecker creates a new Checker
+func NewChecker(logger *zap.SugaredLogger, config Config) *Checker {
+	return &Checker{
+		config:  config,
+		logger:  logger,
+		started: time.Now(),
+		now:     time.Now,
+	}
+}
+
+// Ready returns an error until the caches are synced and rules were applied, and if no reconciliation succeeded
+// within the stall timeout, e.g. because the k8s entities cannot be fetched or the rules cannot be applied.
+func (c *Checker) Ready() error {
+	if !c.config.Synced() {
+		return fmt.Errorf("informer caches are not synced")
+	}
+	last := c.config.LastSuccess()
+	if last.IsZero() {
+		return fmt.Errorf("no rules were applied yet")
+	}
+	if since := c.now().Sub(last); since > c.config.StallTimeout {
+		return fmt.Errorf("no reconciliation succeeded for %s", since.Round(time.Second))
+	}
+	return nil
+}
+
+// Alive returns an error if no reconciliation finished within the stall timeout.
+func (c *Checker) Alive() error {
+	last := c.config.LastReconcile()
+	if last.IsZero() {
+		// the initial sync of the caches may take a while, the reconciliation loop starts after it
+		if !c.config.Synced() {
+			return nil
+		}
+		last = c.started
+	}
+	if since := c.now().Sub(last); since > c.config.StallTimeout {
+		return fmt.Errorf("reconciliation loop is stalled, no reconciliation finished for %s", since.Round(time.Second))
+	}
+	return nil
+}
+
+// LivenessHandler serves the liveness.
+func (c *Checker) LivenessHandler() http.Handler {
+	return handler(c.Alive)
+}
+
+// ReadinessHandler serves the readiness.
+func (c *Checker) ReadinessHandler() http.Handler {
+	return handler(c.Ready)
+}
+
+func handler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// Notify notifies systemd once the controller is ready and pings the systemd watchdog as long as the controller
+// is alive until stop is closed; is blocking. Without notify socket, e.g. when not started by systemd, it returns
+// immediately.
+func (c *Checker) Notify(stop <-chan struct{}) {
+	ok, err := daemon.SdNotify(false, "STATUS=waiting for the initial sync and apply")
+	if err != nil {
+		c.logger.Warnw("unable to notify systemd", "error", err)
+	}
+	if !ok {
+		return
+	}
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		c.logger.Warnw("unable to read systemd watchdog interval", "error", err)
+	}
+	// the watchdog expects a ping within every interval, without watchdog the readiness is checked every second
+	tick := time.Second
+	if interval > 0 {
+		tick = interval / 2
+		c.logger.Infow("pinging systemd watchdog", "interval", interval)
+	}
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	ready := false
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		if !ready && c.Ready() == nil {
+			ready = true
+			c.send(daemon.SdNotifyReady + "\nSTATUS=reconciling firewall rules")
+		}
+		if err := c.Alive(); err != nil {
+			c.logger.Errorw("not pinging systemd watchdog", "error", err)
+			c.send("STATUS=" + err.Error())
+			continue
+		}
+		if interval > 0 {
+			c.send(daemon.SdNotifyWatchdog)
+		}
+	}
+}
+
+func (c *Checker) send(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		c.logger.Warnw("unable to notify systemd", "error", err)
+	}
+}
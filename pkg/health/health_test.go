@@ -0,0 +1,131 @@
+package health
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// state is the controller state a checker is derived from in tests.
+type state struct {
+	synced        bool
+	lastSuccess   time.Time
+	lastReconcile time.Time
+}
+
+func (s *state) checker() *Checker {
+	return NewChecker(zap.NewNop().Sugar(), Config{
+		Synced:        func() bool { return s.synced },
+		LastSuccess:   func() time.Time { return s.lastSuccess },
+		LastReconcile: func() time.Time { return s.lastReconcile },
+		StallTimeout:  time.Minute,
+	})
+}
+
+func status(h http.Handler) int {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	return rec.Code
+}
+
+func TestReadiness(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &state{}
+	c := s.checker()
+	c.now = func() time.Time { return now }
+	if got := status(c.ReadinessHandler()); got != http.StatusServiceUnavailable {
+		t.Errorf("got status %d before the initial sync", got)
+	}
+	s.synced = true
+	if got := status(c.ReadinessHandler()); got != http.StatusServiceUnavailable {
+		t.Errorf("got status %d before rules were applied", got)
+	}
+	s.lastSuccess = now
+	if got := status(c.ReadinessHandler()); got != http.StatusOK {
+		t.Errorf("got status %d, want ready", got)
+	}
+	// failing reconciliations only finish without success
+	now = now.Add(2 * time.Minute)
+	s.lastReconcile = now
+	if got := status(c.ReadinessHandler()); got != http.StatusServiceUnavailable {
+		t.Errorf("got status %d without successful reconciliation for longer than the stall timeout", got)
+	}
+	s.lastSuccess = now
+	if got := status(c.ReadinessHandler()); got != http.StatusOK {
+		t.Errorf("got status %d after a successful reconciliation, want ready again", got)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &state{}
+	c := s.checker()
+	c.started = now
+	c.now = func() time.Time { return now }
+
+	now = now.Add(time.Hour)
+	if got := status(c.LivenessHandler()); got != http.StatusOK {
+		t.Errorf("got status %d during the initial sync", got)
+	}
+	s.synced = true
+	if got := status(c.LivenessHandler()); got != http.StatusServiceUnavailable {
+		t.Errorf("got status %d without reconciliation after the initial sync", got)
+	}
+	s.lastReconcile = now.Add(-30 * time.Second)
+	if got := status(c.LivenessHandler()); got != http.StatusOK {
+		t.Errorf("got status %d after a recent reconciliation", got)
+	}
+	now = now.Add(time.Minute)
+	if got := status(c.LivenessHandler()); got != http.StatusServiceUnavailable {
+		t.Errorf("got status %d with stalled reconciliation loop", got)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	socket := path.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socket)
+	os.Setenv("WATCHDOG_USEC", "200000")
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	s := &state{synced: true, lastSuccess: time.Now(), lastReconcile: time.Now()}
+	c := s.checker()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		c.Notify(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	want := []string{"STATUS=waiting for the initial sync and apply", "READY=1", "WATCHDOG=1"}
+	buf := make([]byte, 1024)
+	for _, w := range want {
+		err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("got no notification %q: %v", w, err)
+		}
+		if got := string(buf[:n]); !strings.HasPrefix(got, w) {
+			t.Errorf("got notification %q, want %q", got, w)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+// Package leader coordinates the controllers of redundant firewalls. The elected leader publishes the ruleset it
+// applied as the desired ruleset and all instances verify that they converge to it.
+package leader
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/applier"
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+)
+
+const (
+	// KeyHash holds the hash of the desired ruleset in the config map.
+	KeyHash = "hash"
+	// KeyRevision holds the revision of the desired ruleset, which is increased whenever the hash changes.
+	KeyRevision = "revision"
+	// KeyLeader holds the identity of the instance that published the desired ruleset.
+	KeyLeader = "leader"
+	// KeyAppliedPrefix prefixes the identity of an instance in the key that holds the hash of its applied ruleset.
+	KeyAppliedPrefix = "applied."
+)
+
+// Config holds the configuration of a Coordinator.
+type Config struct {
+	// Identity identifies this instance in the lease and the config map
+	Identity string
+	// Namespace of the lease and the config map
+	Namespace string
+	// Lease is the name of the lease that is used for the election
+	Lease string
+	// ConfigMap is the name of the config map that holds the desired ruleset
+	ConfigMap string
+	// ConvergenceTimeout is the time an instance may apply another ruleset than the desired one before it is
+	// reported as divergent
+	ConvergenceTimeout time.Duration
+	// VerifyInterval is the interval for verifying the convergence
+	VerifyInterval time.Duration
+}
+
+// Divergence describes that the applied ruleset differs from the desired ruleset.
+type Divergence struct {
+	Since    time.Time
+	Applied  string
+	Desired  string
+	Revision int
+	Leader   string
+}
+
+// Coordinator takes part in the leader election and publishes or verifies the desired ruleset.
+type Coordinator struct {
+	client k8s.Interface
+	config Config
+	logger *zap.SugaredLogger
+	now    func() time.Time
+
+	mu         sync.Mutex
+	leading    bool
+	applied    string
+	revision   int
+	divergence *Divergence
+}
+
+// New creates a new Coordinator
+func New(logger *zap.SugaredLogger, client k8s.Interface, config Config) *Coordinator {
+	return &Coordinator{
+		client: client,
+		config: config,
+		logger: logger,
+		now:    time.Now,
+	}
+}
+
+// Run takes part in the leader election and verifies the convergence until the context is done; is blocking.
+func (c *Coordinator) Run(ctx context.Context) {
+	go c.verifyLoop(ctx)
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: c.config.Namespace, Name: c.config.Lease},
+		Client:     c.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: c.config.Identity},
+	}
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   15 * time.Second,
+			RenewDeadline:   10 * time.Second,
+			RetryPeriod:     2 * time.Second,
+			ReleaseOnCancel: true,
+			Name:            c.config.Lease,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(context.Context) {
+					c.logger.Infow("started leading, publishing the desired ruleset", "identity", c.config.Identity)
+					c.setLeading(true)
+				},
+				OnStoppedLeading: func() {
+					c.logger.Infow("stopped leading", "identity", c.config.Identity)
+					c.setLeading(false)
+				},
+				OnNewLeader: func(identity string) {
+					if identity != c.config.Identity {
+						c.logger.Infow("following leader", "leader", identity)
+					}
+				},
+			},
+		})
+	}
+}
+
+// Applier returns an applier that applies the rules with the given applier and records them as the rules
+// applied by this instance.
+func (c *Coordinator) Applier(a applier.Applier) applier.Applier {
+	return &coordinatedApplier{applier: a, coordinator: c}
+}
+
+// Leading returns whether this instance is the leader.
+func (c *Coordinator) Leading() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leading
+}
+
+// Revision returns the revision of the desired ruleset that was last seen, zero if none was seen yet.
+func (c *Coordinator) Revision() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.revision
+}
+
+// Divergence returns the divergence of this instance from the desired ruleset, nil if it converged or is
+// still within the convergence timeout.
+func (c *Coordinator) Divergence() *Divergence {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.divergence == nil || c.now().Sub(c.divergence.Since) < c.config.ConvergenceTimeout {
+		return nil
+	}
+	d := *c.divergence
+	return &d
+}
+
+var (
+	leaderDesc = prometheus.NewDesc("firewall_policy_controller_leader",
+		"Whether this firewall is the leader that publishes the desired ruleset, 1 if it leads.",
+		nil, nil)
+	revisionDesc = prometheus.NewDesc("firewall_policy_controller_desired_ruleset_revision",
+		"Revision of the desired ruleset that was last seen, 0 if none was seen yet.",
+		nil, nil)
+	divergenceDesc = prometheus.NewDesc("firewall_policy_controller_ruleset_divergence_seconds",
+		"Time since the applied ruleset differs from the desired ruleset once the convergence timeout passed, 0 if it converged.",
+		nil, nil)
+)
+
+// Describe implements prometheus.Collector.
+func (c *Coordinator) Describe(ch chan<- *prometheus.Desc) {
+	ch <- leaderDesc
+	ch <- revisionDesc
+	ch <- divergenceDesc
+}
+
+// Collect implements prometheus.Collector, it exports the leadership, the revision of the desired ruleset and
+// the divergence from it.
+func (c *Coordinator) Collect(ch chan<- prometheus.Metric) {
+	leading := 0.0
+	if c.Leading() {
+		leading = 1
+	}
+	diverged := 0.0
+	if d := c.Divergence(); d != nil {
+		diverged = c.now().Sub(d.Since).Seconds()
+	}
+	ch <- prometheus.MustNewConstMetric(leaderDesc, prometheus.GaugeValue, leading)
+	ch <- prometheus.MustNewConstMetric(revisionDesc, prometheus.GaugeValue, float64(c.Revision()))
+	ch <- prometheus.MustNewConstMetric(divergenceDesc, prometheus.GaugeValue, diverged)
+}
+
+func (c *Coordinator) setLeading(leading bool) {
+	c.mu.Lock()
+	c.leading = leading
+	c.mu.Unlock()
+	if leading {
+		c.publish()
+	}
+}
+
+// setApplied records the hash of the applied rules and publishes it.
+func (c *Coordinator) setApplied(hash string) {
+	c.mu.Lock()
+	c.applied = hash
+	c.mu.Unlock()
+	c.publish()
+}
+
+// publish writes the hash of the applied ruleset of this instance to the config map, the leader also publishes
+// it as the desired ruleset.
+func (c *Coordinator) publish() {
+	c.mu.Lock()
+	applied, leading := c.applied, c.leading
+	c.mu.Unlock()
+	if applied == "" {
+		return
+	}
+	var revision int
+	err := c.updateConfigMap(func(cm *corev1.ConfigMap) {
+		cm.Data[KeyAppliedPrefix+c.config.Identity] = applied
+		revision, _ = strconv.Atoi(cm.Data[KeyRevision])
+		if !leading || cm.Data[KeyHash] == applied {
+			return
+		}
+		revision++
+		cm.Data[KeyHash] = applied
+		cm.Data[KeyRevision] = strconv.Itoa(revision)
+		cm.Data[KeyLeader] = c.config.Identity
+	})
+	if err != nil {
+		c.logger.Errorw("unable to publish applied ruleset", "hash", applied, "error", err)
+		return
+	}
+	if leading {
+		c.mu.Lock()
+		c.revision = revision
+		c.mu.Unlock()
+		c.logger.Infow("published desired ruleset", "hash", applied, "revision", revision)
+	}
+	c.verify()
+}
+
+func (c *Coordinator) updateConfigMap(update func(cm *corev1.ConfigMap)) error {
+	cms := c.client.CoreV1().ConfigMaps(c.config.Namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := cms.Get(context.Background(), c.config.ConfigMap, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: c.config.Namespace, Name: c.config.ConfigMap}, Data: map[string]string{}}
+			update(cm)
+			_, err = cms.Create(context.Background(), cm, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				return apierrors.NewConflict(corev1.Resource("configmaps"), c.config.ConfigMap, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		update(cm)
+		_, err = cms.Update(context.Background(), cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func (c *Coordinator) verifyLoop(ctx context.Context) {
+	t := time.NewTicker(c.config.VerifyInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			c.verify()
+		}
+	}
+}
+
+// verify compares the applied ruleset with the desired ruleset and reports divergence that lasts longer than
+// the convergence timeout.
+func (c *Coordinator) verify() {
+	cm, err := c.client.CoreV1().ConfigMaps(c.config.Namespace).Get(context.Background(), c.config.ConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return
+	}
+	if err != nil {
+		c.logger.Errorw("unable to read desired ruleset", "error", err)
+		return
+	}
+	desired := cm.Data[KeyHash]
+	revision, _ := strconv.Atoi(cm.Data[KeyRevision])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.revision = revision
+	if desired == "" || desired == c.applied {
+		if c.divergence != nil {
+			c.logger.Infow("converged to the desired ruleset", "hash", desired, "revision", revision)
+		}
+		c.divergence = nil
+		return
+	}
+	if c.divergence == nil || c.divergence.Desired != desired {
+		since := c.now()
+		if c.divergence != nil {
+			since = c.divergence.Since
+		}
+		c.divergence = &Divergence{Since: since, Desired: desired, Revision: revision, Leader: cm.Data[KeyLeader]}
+	}
+	c.divergence.Applied = c.applied
+	if c.now().Sub(c.divergence.Since) >= c.config.ConvergenceTimeout {
+		c.logger.Errorw("applied ruleset diverges from the desired ruleset", "applied", c.applied, "desired", desired, "revision", revision, "leader", cm.Data[KeyLeader], "since", c.divergence.Since)
+	}
+}
+
+// coordinatedApplier records the rules that were applied successfully with the coordinator.
+type coordinatedApplier struct {
+	applier     applier.Applier
+	coordinator *Coordinator
+}
+
+func (a *coordinatedApplier) Apply(rules *controller.FirewallRules) error {
+	err := a.applier.Apply(rules)
+	if err != nil {
+		return err
+	}
+	a.coordinator.setApplied(rules.Hash())
+	return nil
+}
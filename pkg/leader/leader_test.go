@@ -0,0 +1,102 @@
+package leader
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/applier"
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+)
+
+func TestCoordinator(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	desired := &controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Verdict: controller.VerdictAccept, Comment: "1"}}}
+	diverged := &controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Verdict: controller.VerdictAccept, Comment: "2"}}}
+	changed := &controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Verdict: controller.VerdictAccept, Comment: "3"}}}
+	config := Config{Namespace: "firewall", Lease: "firewall-policy-controller", ConfigMap: "firewall-ruleset", ConvergenceTimeout: time.Minute}
+	newCoordinator := func(identity string) (*Coordinator, applier.Applier) {
+		config.Identity = identity
+		c := New(zap.NewNop().Sugar(), client, config)
+		c.now = func() time.Time { return now }
+		return c, c.Applier(&applier.Fake{})
+	}
+	leader, leaderApplier := newCoordinator("firewall-a")
+	follower, followerApplier := newCoordinator("firewall-b")
+	leader.setLeading(true)
+
+	err := leaderApplier.Apply(desired)
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	cm, err := client.CoreV1().ConfigMaps("firewall").Get(context.Background(), "firewall-ruleset", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("desired ruleset was not published: %v", err)
+	}
+	if cm.Data[KeyHash] != desired.Hash() || cm.Data[KeyRevision] != "1" || cm.Data[KeyLeader] != "firewall-a" {
+		t.Errorf("got published data %v", cm.Data)
+	}
+
+	// followers do not publish their rules as desired ruleset
+	err = followerApplier.Apply(diverged)
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if d := follower.Divergence(); d != nil {
+		t.Errorf("got divergence %+v within the convergence timeout", d)
+	}
+	now = now.Add(time.Minute)
+	follower.verify()
+	d := follower.Divergence()
+	if d == nil {
+		t.Fatal("divergence was not reported")
+	}
+	if d.Applied != diverged.Hash() || d.Desired != desired.Hash() || d.Revision != 1 || d.Leader != "firewall-a" {
+		t.Errorf("got divergence %+v", d)
+	}
+	want := `# HELP firewall_policy_controller_desired_ruleset_revision Revision of the desired ruleset that was last seen, 0 if none was seen yet.
+# TYPE firewall_policy_controller_desired_ruleset_revision gauge
+firewall_policy_controller_desired_ruleset_revision 1
+# HELP firewall_policy_controller_leader Whether this firewall is the leader that publishes the desired ruleset, 1 if it leads.
+# TYPE firewall_policy_controller_leader gauge
+firewall_policy_controller_leader 0
+# HELP firewall_policy_controller_ruleset_divergence_seconds Time since the applied ruleset differs from the desired ruleset once the convergence timeout passed, 0 if it converged.
+# TYPE firewall_policy_controller_ruleset_divergence_seconds gauge
+firewall_policy_controller_ruleset_divergence_seconds 60
+`
+	err = testutil.CollectAndCompare(follower, strings.NewReader(want))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = followerApplier.Apply(desired)
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if d := follower.Divergence(); d != nil {
+		t.Errorf("got divergence %+v after converging", d)
+	}
+
+	// a new ruleset increases the revision
+	err = leaderApplier.Apply(changed)
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if leader.Revision() != 2 {
+		t.Errorf("Revision() = %d, want 2", leader.Revision())
+	}
+	cm, err = client.CoreV1().ConfigMaps("firewall").Get(context.Background(), "firewall-ruleset", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.Data[KeyAppliedPrefix+"firewall-a"] != changed.Hash() || cm.Data[KeyAppliedPrefix+"firewall-b"] != desired.Hash() {
+		t.Errorf("got applied rulesets %v", cm.Data)
+	}
+}
@@ -0,0 +1,101 @@
+// Package metrics holds the prometheus metrics of the controller.
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "firewall_policy_controller"
+
+var (
+	// ReconcileDuration observes the duration of reconciliations.
+	ReconcileDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "reconcile_duration_seconds",
+		Help:      "Duration of the reconciliation of the firewall rules.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+	// FetchErrors counts the failures to fetch the k8s entities and assemble the rules for them.
+	FetchErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "fetch_errors_total",
+		Help:      "Number of failures to fetch the k8s entities and assemble the firewall rules.",
+	})
+	// Rules holds the number of applied rules by direction.
+	Rules = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rules",
+		Help:      "Number of applied firewall rules by direction.",
+	}, []string{"direction"})
+	// ApplyFailures counts the failures to apply the rules by the stage that failed.
+	ApplyFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "apply_failures_total",
+		Help:      "Number of failures to apply the firewall rules by stage.",
+	}, []string{"stage"})
+	// Rollbacks counts the applied rules that failed the health probes by whether the last known-good rules were
+	// restored or not.
+	Rollbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rollbacks_total",
+		Help:      "Number of applied firewall rules that failed the health probes by result of the rollback, restored or failed.",
+	}, []string{"result"})
+	// WatchRestarts counts the restarts of failed watches by resource.
+	WatchRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watch_restarts_total",
+		Help:      "Number of restarts of failed watches for k8s entities by resource.",
+	}, []string{"resource"})
+	// StaleSince holds the time of the first failed fetch since which the firewall rules are stale, set it with
+	// SetStaleSince.
+	StaleSince = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stale_since_timestamp_seconds",
+		Help:      "Time of the first failed fetch of the k8s entities since which the firewall rules are stale, 0 if the last fetch succeeded.",
+	})
+
+	lastApply = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_successful_apply_timestamp_seconds",
+		Help:      "Time of the last successful apply of the firewall rules or of the last check that the applied rules are up to date.",
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "seconds_since_last_successful_apply",
+		Help:      "Time since the last successful apply of the firewall rules or since the last check that the applied rules are up to date, -1 if no rules were applied yet.",
+	}, sinceLastApply)
+
+	mu            sync.Mutex
+	lastAppliedAt time.Time
+)
+
+// SetApplied records a successful apply or that the applied rules are up to date at the given time.
+func SetApplied(t time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+	lastAppliedAt = t
+	lastApply.Set(float64(t.UnixNano()) / 1e9)
+}
+
+func sinceLastApply() float64 {
+	mu.Lock()
+	defer mu.Unlock()
+	if lastAppliedAt.IsZero() {
+		return -1
+	}
+	return time.Since(lastAppliedAt).Seconds()
+}
+
+// SetStaleSince records the time since which the k8s entities could not be fetched, the zero time if the last fetch
+// succeeded.
+func SetStaleSince(t time.Time) {
+	if t.IsZero() {
+		StaleSince.Set(0)
+		return
+	}
+	StaleSince.Set(float64(t.UnixNano()) / 1e9)
+}
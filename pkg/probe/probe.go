@@ -0,0 +1,156 @@
+// Package probe checks the reachability of targets the firewall must not lock out.
+package probe
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// Probe checks that a target is reachable.
+type Probe interface {
+	// Check returns an error if the target cannot be reached before the context is done.
+	Check(ctx context.Context) error
+	// String describes the target of the probe.
+	String() string
+}
+
+// APIServer checks that the health endpoint of the kube-apiserver responds.
+type APIServer struct {
+	client k8s.Interface
+}
+
+// NewAPIServer creates a new APIServer probe
+func NewAPIServer(client k8s.Interface) *APIServer {
+	return &APIServer{
+		client: client,
+	}
+}
+
+// Check requests the health endpoint of the kube-apiserver.
+func (p *APIServer) Check(ctx context.Context) error {
+	_, err := p.client.Discovery().RESTClient().Get().AbsPath("/healthz").Do(ctx).Raw()
+	if err != nil {
+		return fmt.Errorf("kube-apiserver is not healthy: %w", err)
+	}
+	return nil
+}
+
+func (p *APIServer) String() string {
+	return "kube-apiserver"
+}
+
+// TCP checks that a tcp connection can be established to an address like "10.0.0.1:443".
+type TCP struct {
+	address string
+}
+
+// NewTCP creates a new TCP probe
+func NewTCP(address string) *TCP {
+	return &TCP{
+		address: address,
+	}
+}
+
+// Check connects to the address and closes the connection.
+func (p *TCP) Check(ctx context.Context) error {
+	d := net.Dialer{}
+	c, err := d.DialContext(ctx, "tcp", p.address)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+func (p *TCP) String() string {
+	return "tcp " + p.address
+}
+
+// ICMP checks that a host answers an echo request. It needs the privileges to open raw sockets.
+type ICMP struct {
+	host string
+}
+
+// NewICMP creates a new ICMP probe
+func NewICMP(host string) *ICMP {
+	return &ICMP{
+		host: host,
+	}
+}
+
+// Check sends an echo request to the host and waits for the echo reply.
+func (p *ICMP) Check(ctx context.Context) error {
+	r := net.Resolver{}
+	addrs, err := r.LookupIPAddr(ctx, p.host)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("no address for %s", p.host)
+	}
+	ip := addrs[0].IP
+
+	network, listen := "ip4:icmp", "0.0.0.0"
+	var request, reply byte = 8, 0
+	if ip.To4() == nil {
+		network, listen = "ip6:ipv6-icmp", "::"
+		request, reply = 128, 129
+	}
+	c, err := net.ListenPacket(network, listen)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	err = c.SetDeadline(deadline)
+	if err != nil {
+		return err
+	}
+
+	id := uint16(os.Getpid())
+	_, err = c.WriteTo(echo(request, id), &net.IPAddr{IP: ip})
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := c.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		// the ip header is not part of the packets of ip sockets
+		if n >= 8 && buf[0] == reply && binary.BigEndian.Uint16(buf[4:6]) == id && peer.(*net.IPAddr).IP.Equal(ip) {
+			return nil
+		}
+	}
+}
+
+// echo returns an icmp echo request with the identifier, the kernel calculates the checksum of icmpv6 messages.
+func echo(request byte, id uint16) []byte {
+	b := make([]byte, 8)
+	b[0] = request
+	binary.BigEndian.PutUint16(b[4:6], id)
+	binary.BigEndian.PutUint16(b[6:8], 1)
+	if request == 8 {
+		var sum uint32
+		for i := 0; i < len(b); i += 2 {
+			sum += uint32(b[i])<<8 | uint32(b[i+1])
+		}
+		sum = sum>>16 + sum&0xffff
+		sum += sum >> 16
+		binary.BigEndian.PutUint16(b[2:4], ^uint16(sum))
+	}
+	return b
+}
+
+func (p *ICMP) String() string {
+	return "icmp " + p.host
+}
@@ -0,0 +1,36 @@
+package probe
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = NewTCP(address).Check(ctx)
+	if err != nil {
+		t.Errorf("Check() error = %v", err)
+	}
+	l.Close()
+	err = NewTCP(address).Check(ctx)
+	if err == nil {
+		t.Errorf("Check() of closed port succeeded")
+	}
+}
+
+func TestICMP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := NewICMP("127.0.0.1").Check(ctx)
+	if err != nil {
+		t.Skipf("unable to ping localhost, probably missing privileges: %v", err)
+	}
+}
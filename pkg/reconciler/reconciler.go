@@ -0,0 +1,282 @@
+// Package reconciler assembles the firewall rules from k8s and applies them when they change.
+package reconciler
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/applier"
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+	"github.com/metal-stack/firewall-policy-controller/pkg/metrics"
+)
+
+// StalePolicy decides which rules are enforced once the k8s entities could not be fetched for longer than
+// the maximum staleness.
+type StalePolicy string
+
+const (
+	// StalePolicyKeep keeps enforcing the last good rules.
+	StalePolicyKeep StalePolicy = "keep"
+	// StalePolicyOpen accepts all forwarded traffic.
+	StalePolicyOpen StalePolicy = "open"
+	// StalePolicyClosed removes all dynamic rules, so only established connections and icmp are accepted.
+	StalePolicyClosed StalePolicy = "closed"
+)
+
+// Assembler fetches the k8s entities and assembles the firewall rules for them.
+type Assembler interface {
+	FetchAndAssemble() (*controller.FirewallRules, error)
+}
+
+// StatusReporter reports the enforcement status of the services and network policies whose rules are applied.
+type StatusReporter interface {
+	Report(rules *controller.FirewallRules)
+}
+
+// Config holds the configuration of a Reconciler.
+type Config struct {
+	// DryRun only logs the rules instead of applying them
+	DryRun bool
+	// MaxStaleness is the time after which the StalePolicy applies if fetching fails, zero means never
+	MaxStaleness time.Duration
+	StalePolicy  StalePolicy
+	// Debounce is the time changes are collected before they are reconciled
+	Debounce time.Duration
+	// Reporter is optional and reports the status of the objects once their rules are applied
+	Reporter StatusReporter
+	// Heartbeat is the interval in which a reconciliation is enqueued without changes, so that the liveness
+	// and the stale policy do not depend on the resync of the informers, zero disables it
+	Heartbeat time.Duration
+}
+
+// queueKey is the only key of the work queue, all changes lead to the reconciliation of the whole ruleset.
+const queueKey = "firewall"
+
+// Reconciler applies the rules of the assembler. If fetching fails, the last good rules are kept until the
+// maximum staleness is reached.
+type Reconciler struct {
+	assembler Assembler
+	applier   applier.Applier
+	logger    *zap.SugaredLogger
+	config    Config
+	now       func() time.Time
+	queue     workqueue.RateLimitingInterface
+
+	mu            sync.Mutex
+	applied       *controller.FirewallRules
+	staleSince    time.Time
+	lastReconcile time.Time
+	lastSuccess   time.Time
+}
+
+// New creates a new Reconciler
+func New(logger *zap.SugaredLogger, assembler Assembler, applier applier.Applier, config Config) *Reconciler {
+	if config.StalePolicy == "" {
+		config.StalePolicy = StalePolicyKeep
+	}
+	return &Reconciler{
+		assembler: assembler,
+		applier:   applier,
+		logger:    logger,
+		config:    config,
+		now:       time.Now,
+		queue:     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "firewall"),
+	}
+}
+
+// Enqueue schedules a reconciliation after the debounce time, changes until then are reconciled together.
+func (r *Reconciler) Enqueue() {
+	r.queue.AddAfter(queueKey, r.config.Debounce)
+}
+
+// EventHandler returns a handler for informers that enqueues a reconciliation for every event.
+func (r *Reconciler) EventHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { r.Enqueue() },
+		UpdateFunc: func(interface{}, interface{}) { r.Enqueue() },
+		DeleteFunc: func(interface{}) { r.Enqueue() },
+	}
+}
+
+// Run reconciles the enqueued changes until stop is closed; is blocking. Failed reconciliations are retried
+// with an exponential backoff.
+func (r *Reconciler) Run(stop <-chan struct{}) {
+	defer r.queue.ShutDown()
+	if r.config.Heartbeat > 0 {
+		go wait.Until(r.Enqueue, r.config.Heartbeat, stop)
+	}
+	go wait.Until(r.worker, time.Second, stop)
+	<-stop
+}
+
+func (r *Reconciler) worker() {
+	for r.processNext() {
+	}
+}
+
+func (r *Reconciler) processNext() bool {
+	key, quit := r.queue.Get()
+	if quit {
+		return false
+	}
+	defer r.queue.Done(key)
+	err := r.Reconcile()
+	if err == nil {
+		r.queue.Forget(key)
+		return true
+	}
+	if staleSince := r.StaleSince(); !staleSince.IsZero() {
+		r.logger.Errorw("reconciliation failed, the firewall rules are stale", "error", err, "staleSince", staleSince)
+	} else {
+		r.logger.Errorw("reconciliation failed", "error", err)
+	}
+	r.queue.AddRateLimited(key)
+	return true
+}
+
+// Reconcile fetches and assembles the rules and applies them if they changed since the last successful apply.
+// It must not be called concurrently.
+func (r *Reconciler) Reconcile() (err error) {
+	start := time.Now()
+	defer func() {
+		metrics.ReconcileDuration.Observe(time.Since(start).Seconds())
+		r.mu.Lock()
+		r.lastReconcile = r.now()
+		if err == nil {
+			r.lastSuccess = r.lastReconcile
+		}
+		r.mu.Unlock()
+	}()
+	rules, fetchErr := r.assembler.FetchAndAssemble()
+	r.mu.Lock()
+	if fetchErr != nil {
+		metrics.FetchErrors.Inc()
+		// failing watches leave the caches stale since their first failure, not since it is noticed
+		since := r.now()
+		var stale *controller.StaleError
+		if errors.As(fetchErr, &stale) {
+			since = stale.Since
+		}
+		if r.staleSince.IsZero() || since.Before(r.staleSince) {
+			r.staleSince = since
+		}
+		fetchErr = fmt.Errorf("could not fetch k8s entities to build firewall rules: %w", fetchErr)
+		rules = r.staleRules()
+	} else {
+		r.staleSince = time.Time{}
+	}
+	staleSince, applied := r.staleSince, r.applied
+	r.mu.Unlock()
+	metrics.SetStaleSince(staleSince)
+	if rules == nil {
+		return fetchErr
+	}
+	if !rules.HasChanged(applied) {
+		if !r.config.DryRun {
+			r.observe(applied, fetchErr)
+		}
+		r.report(rules, fetchErr)
+		return fetchErr
+	}
+	if fetchErr != nil {
+		r.logger.Warnw("firewall rules are stale, enforcing the stale policy", "policy", r.config.StalePolicy, "staleSince", staleSince)
+	}
+
+	r.logger.Infow("new fw rules to enforce", "ingress", len(rules.IngressRules), "egress", len(rules.EgressRules), "sets", len(rules.Sets), "maps", len(rules.Maps), "chains", len(rules.Chains))
+	// the rules are only shown in dry runs or at debug level, they are logged with every change
+	logRule := r.logger.Debugw
+	if r.config.DryRun {
+		logRule = r.logger.Infow
+	}
+	for k, i := range rules.IngressRules {
+		logRule("ingress rule", "index", k+1, "rule", i.String(), "origins", i.Origins)
+	}
+	for k, e := range rules.EgressRules {
+		logRule("egress rule", "index", k+1, "rule", e.String(), "origins", e.Origins)
+	}
+	if !r.config.DryRun {
+		err := r.applier.Apply(rules)
+		if err != nil {
+			metrics.ApplyFailures.WithLabelValues(applier.Stage(err)).Inc()
+			// rules that failed to apply are retried with the next reconciliation
+			return fmt.Errorf("unable to apply firewall rules: %w", err)
+		}
+		r.logger.Info("applied new set of nftable rules")
+		r.observe(rules, fetchErr)
+	}
+	r.mu.Lock()
+	r.applied = rules
+	r.mu.Unlock()
+	r.report(rules, fetchErr)
+	return fetchErr
+}
+
+// observe records the metrics of the applied rules, stale rules do not count as successful apply.
+func (r *Reconciler) observe(rules *controller.FirewallRules, fetchErr error) {
+	metrics.Rules.WithLabelValues("ingress").Set(float64(len(rules.IngressRules)))
+	metrics.Rules.WithLabelValues("egress").Set(float64(len(rules.EgressRules)))
+	if fetchErr == nil {
+		metrics.SetApplied(r.now())
+	}
+}
+
+// report reports the statuses of rules that were assembled from fresh k8s entities and are applied.
+func (r *Reconciler) report(rules *controller.FirewallRules, fetchErr error) {
+	if r.config.Reporter == nil || r.config.DryRun || fetchErr != nil {
+		return
+	}
+	r.config.Reporter.Report(rules)
+}
+
+// LastReconcile returns the time the last reconciliation finished, successful or not, zero if none finished yet.
+func (r *Reconciler) LastReconcile() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastReconcile
+}
+
+// LastSuccess returns the time the last successful reconciliation finished, in which the rules were assembled from
+// fresh k8s entities and applied or are up to date, zero if none succeeded yet.
+func (r *Reconciler) LastSuccess() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastSuccess
+}
+
+// StaleSince returns the time since which the k8s entities could not be fetched, zero if the last fetch succeeded.
+func (r *Reconciler) StaleSince() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.staleSince
+}
+
+// staleRules returns the rules of the stale policy once the maximum staleness is reached, nil if the applied
+// rules are kept.
+func (r *Reconciler) staleRules() *controller.FirewallRules {
+	if r.config.MaxStaleness == 0 || r.now().Sub(r.staleSince) < r.config.MaxStaleness {
+		return nil
+	}
+	switch r.config.StalePolicy {
+	case StalePolicyOpen:
+		rules := &controller.FirewallRules{StalePolicy: true}
+		for _, fam := range []controller.Family{controller.FamilyIPv4, controller.FamilyIPv6} {
+			rules.IngressRules = append(rules.IngressRules, controller.Rule{
+				Family:  fam,
+				Counter: true,
+				Verdict: controller.VerdictAccept,
+				Comment: "accept all traffic because the firewall rules are stale",
+			})
+		}
+		return rules
+	case StalePolicyClosed:
+		return &controller.FirewallRules{StalePolicy: true}
+	}
+	return nil
+}
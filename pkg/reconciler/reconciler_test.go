@@ -0,0 +1,388 @@
+package reconciler
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/applier"
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+	"github.com/metal-stack/firewall-policy-controller/pkg/metrics"
+)
+
+// fakeAssembler returns the rules or the error.
+type fakeAssembler struct {
+	rules *controller.FirewallRules
+	err   error
+}
+
+func (a *fakeAssembler) FetchAndAssemble() (*controller.FirewallRules, error) {
+	return a.rules, a.err
+}
+
+func TestReconcile(t *testing.T) {
+	rule := controller.Rule{Family: controller.FamilyIPv4, Counter: true, Verdict: controller.VerdictAccept, Comment: "1"}
+	as := &fakeAssembler{rules: &controller.FirewallRules{IngressRules: []controller.Rule{rule}}}
+	ap := &applier.Fake{}
+	r := New(zap.NewNop().Sugar(), as, ap, Config{})
+
+	err := r.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if len(ap.Applied()) != 1 {
+		t.Fatalf("got %d applies, want 1", len(ap.Applied()))
+	}
+
+	// unchanged rules are not applied again
+	as.rules = &controller.FirewallRules{IngressRules: []controller.Rule{rule}}
+	err = r.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if len(ap.Applied()) != 1 {
+		t.Errorf("got %d applies, want 1", len(ap.Applied()))
+	}
+
+	// failed applies are retried
+	rule.Comment = "2"
+	as.rules = &controller.FirewallRules{IngressRules: []controller.Rule{rule}}
+	ap.Err = errors.New("apply failed")
+	failures := testutil.ToFloat64(metrics.ApplyFailures.WithLabelValues(applier.StageUnknown))
+	err = r.Reconcile()
+	if err == nil {
+		t.Fatalf("Reconcile() succeeded, want the apply error")
+	}
+	if got := testutil.ToFloat64(metrics.ApplyFailures.WithLabelValues(applier.StageUnknown)); got != failures+1 {
+		t.Errorf("got %v apply failures, want %v", got, failures+1)
+	}
+	ap.Err = nil
+	err = r.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if ap.Current() != as.rules {
+		t.Errorf("got current rules %v, want %v", ap.Current(), as.rules)
+	}
+}
+
+func TestReconcileKeepsRulesWhenFetchFails(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	rules := &controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Counter: true, Verdict: controller.VerdictAccept, Comment: "1"}}}
+	as := &fakeAssembler{rules: rules}
+	ap := &applier.Fake{}
+	r := New(zap.NewNop().Sugar(), as, ap, Config{})
+	r.now = func() time.Time { return now }
+
+	err := r.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	as.rules, as.err = nil, errors.New("api server unreachable")
+	for i := 0; i < 3; i++ {
+		err = r.Reconcile()
+		if err == nil {
+			t.Fatalf("Reconcile() succeeded, want the fetch error")
+		}
+		now = now.Add(time.Hour)
+	}
+	if len(ap.Applied()) != 1 {
+		t.Errorf("got %d applies, want the rules to be kept", len(ap.Applied()))
+	}
+	if want := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC); !r.StaleSince().Equal(want) {
+		t.Errorf("StaleSince() = %v, want %v", r.StaleSince(), want)
+	}
+	if got, want := testutil.ToFloat64(metrics.StaleSince), float64(1609459200); got != want {
+		t.Errorf("stale since metric = %v, want %v", got, want)
+	}
+	if want := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC); !r.LastSuccess().Equal(want) {
+		t.Errorf("LastSuccess() = %v, want the time of the last successful fetch %v", r.LastSuccess(), want)
+	}
+
+	as.rules, as.err = rules, nil
+	err = r.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if !r.StaleSince().IsZero() {
+		t.Errorf("StaleSince() = %v, want zero after a successful fetch", r.StaleSince())
+	}
+	if got := testutil.ToFloat64(metrics.StaleSince); got != 0 {
+		t.Errorf("stale since metric = %v, want 0 after a successful fetch", got)
+	}
+	if !r.LastSuccess().Equal(now) {
+		t.Errorf("LastSuccess() = %v, want %v", r.LastSuccess(), now)
+	}
+}
+
+func TestReconcileStalePolicy(t *testing.T) {
+	tests := []struct {
+		policy StalePolicy
+		want   int
+	}{
+		{policy: StalePolicyKeep, want: 1},
+		{policy: StalePolicyOpen, want: 2},
+		{policy: StalePolicyClosed, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+			as := &fakeAssembler{rules: &controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Counter: true, Verdict: controller.VerdictAccept, Comment: "1"}}}}
+			ap := &applier.Fake{}
+			r := New(zap.NewNop().Sugar(), as, ap, Config{MaxStaleness: time.Minute, StalePolicy: tt.policy})
+			r.now = func() time.Time { return now }
+
+			err := r.Reconcile()
+			if err != nil {
+				t.Fatalf("Reconcile() error = %v", err)
+			}
+			as.rules, as.err = nil, errors.New("api server unreachable")
+			_ = r.Reconcile()
+			if len(ap.Applied()) != 1 {
+				t.Fatalf("got %d applies before the maximum staleness, want 1", len(ap.Applied()))
+			}
+			now = now.Add(time.Minute)
+			_ = r.Reconcile()
+			if got := len(ap.Current().IngressRules); got != tt.want {
+				t.Errorf("got %d rules after the maximum staleness, want %d", got, tt.want)
+			}
+			// the rules of the stale policy bypass the deletion guard
+			if got := ap.Current().StalePolicy; got != (tt.policy != StalePolicyKeep) {
+				t.Errorf("got rules of the stale policy %t", got)
+			}
+		})
+	}
+}
+
+func TestReconcileDryRun(t *testing.T) {
+	ap := &applier.Fake{}
+	logs, observed := observer.New(zap.InfoLevel)
+	r := New(zap.New(logs).Sugar(), &fakeAssembler{rules: &controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Counter: true, Verdict: controller.VerdictAccept, Comment: "1"}}}}, ap, Config{DryRun: true})
+	err := r.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if len(ap.Applied()) != 0 {
+		t.Errorf("got %d applies in dry run", len(ap.Applied()))
+	}
+	if n := observed.FilterMessage("ingress rule").Len(); n != 1 {
+		t.Errorf("got %d logged ingress rules in dry run, want 1", n)
+	}
+}
+
+func TestReconcileLogsRulesAtDebugLevel(t *testing.T) {
+	logs, observed := observer.New(zap.InfoLevel)
+	r := New(zap.New(logs).Sugar(), &fakeAssembler{rules: &controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Counter: true, Verdict: controller.VerdictAccept, Comment: "1"}}}}, &applier.Fake{}, Config{})
+	err := r.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if n := observed.FilterMessage("ingress rule").Len(); n != 0 {
+		t.Errorf("got %d ingress rules logged at info level, want them at debug level", n)
+	}
+}
+
+// flakyAssembler fails the given number of times before it returns the rules.
+type flakyAssembler struct {
+	fails int
+	rules *controller.FirewallRules
+}
+
+func (a *flakyAssembler) FetchAndAssemble() (*controller.FirewallRules, error) {
+	if a.fails > 0 {
+		a.fails--
+		return nil, errors.New("assembly failed")
+	}
+	return a.rules, nil
+}
+
+func TestRun(t *testing.T) {
+	ap := &applier.Fake{}
+	r := New(zap.NewNop().Sugar(), &flakyAssembler{fails: 2, rules: &controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Counter: true, Verdict: controller.VerdictAccept, Comment: "1"}}}}, ap, Config{Debounce: 10 * time.Millisecond})
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.Run(stop)
+
+	// events are collected and failed reconciliations are retried
+	for i := 0; i < 5; i++ {
+		r.Enqueue()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ap.Applied()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("rules were not applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(ap.Applied()) != 1 {
+		t.Errorf("got %d applies, want 1", len(ap.Applied()))
+	}
+}
+
+// TestRunHeartbeat checks that reconciliations finish without changes and without resyncs of the informers.
+func TestRunHeartbeat(t *testing.T) {
+	ap := &applier.Fake{}
+	r := New(zap.NewNop().Sugar(), &fakeAssembler{rules: &controller.FirewallRules{IngressRules: []controller.Rule{{Family: controller.FamilyIPv4, Counter: true, Verdict: controller.VerdictAccept, Comment: "1"}}}}, ap, Config{Heartbeat: 10 * time.Millisecond})
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.Run(stop)
+
+	var first time.Time
+	deadline := time.Now().Add(5 * time.Second)
+	for first.IsZero() || !r.LastReconcile().After(first) {
+		if time.Now().After(deadline) {
+			t.Fatal("no reconciliations finished without changes")
+		}
+		if first.IsZero() {
+			first = r.LastReconcile()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(ap.Applied()) != 1 {
+		t.Errorf("got %d applies, want 1", len(ap.Applied()))
+	}
+}
+
+// fakeReporter records the reported rules.
+type fakeReporter struct {
+	reported []*controller.FirewallRules
+}
+
+func (r *fakeReporter) Report(rules *controller.FirewallRules) {
+	r.reported = append(r.reported, rules)
+}
+
+func TestReconcileReportsStatus(t *testing.T) {
+	rule := controller.Rule{Family: controller.FamilyIPv4, Counter: true, Verdict: controller.VerdictAccept, Comment: "1"}
+	as := &fakeAssembler{rules: &controller.FirewallRules{IngressRules: []controller.Rule{rule}}}
+	ap := &applier.Fake{}
+	rep := &fakeReporter{}
+	r := New(zap.NewNop().Sugar(), as, ap, Config{Reporter: rep})
+
+	err := r.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	// statuses may change without changing the rules
+	as.rules = &controller.FirewallRules{IngressRules: []controller.Rule{rule}}
+	err = r.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if len(rep.reported) != 2 || rep.reported[1] != as.rules {
+		t.Errorf("got %d reports, want the statuses of both reconciliations", len(rep.reported))
+	}
+
+	// statuses of rules that failed to apply are not reported
+	rule.Comment = "2"
+	as.rules = &controller.FirewallRules{IngressRules: []controller.Rule{rule}}
+	ap.Err = errors.New("apply failed")
+	_ = r.Reconcile()
+	if len(rep.reported) != 2 {
+		t.Errorf("got %d reports, want no report for rules that failed to apply", len(rep.reported))
+	}
+}
+
+func TestReconcileStaleInformers(t *testing.T) {
+	// the api server becomes unreachable after the initial list of services
+	var mu sync.Mutex
+	unreachable, lists := false, 0
+	var watcher *watch.FakeWatcher
+	client := testclient.NewSimpleClientset()
+	client.PrependReactor("list", "services", func(k8stesting.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if unreachable {
+			return true, nil, errors.New("api server unreachable")
+		}
+		lists++
+		return true, &corev1.ServiceList{ListMeta: metav1.ListMeta{ResourceVersion: strconv.Itoa(lists)}}, nil
+	})
+	client.PrependWatchReactor("services", func(k8stesting.Action) (bool, watch.Interface, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if unreachable {
+			return true, nil, errors.New("api server unreachable")
+		}
+		watcher = watch.NewFakeWithChanSize(1, false)
+		return true, watcher, nil
+	})
+	factory := informers.NewSharedInformerFactory(client, 0)
+	ctr := controller.NewFirewallController(factory, zap.NewNop().Sugar(), controller.Config{})
+	ap := &applier.Fake{}
+	r := New(zap.NewNop().Sugar(), ctr, ap, Config{MaxStaleness: time.Minute, StalePolicy: StalePolicyOpen})
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, ctr.HasSynced) {
+		t.Fatal("caches did not sync")
+	}
+	err := r.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	mu.Lock()
+	unreachable = true
+	watcher.Error(&metav1.Status{Status: metav1.StatusFailure, Message: "connection lost", Reason: metav1.StatusReasonServiceUnavailable})
+	mu.Unlock()
+	fetchErrors := testutil.ToFloat64(metrics.FetchErrors)
+	deadline := time.Now().Add(10 * time.Second)
+	for err == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("failing watch was not reported")
+		}
+		time.Sleep(10 * time.Millisecond)
+		err = r.Reconcile()
+	}
+	var stale *controller.StaleError
+	if !errors.As(err, &stale) || stale.Resource != "services" {
+		t.Fatalf("Reconcile() error = %v, want a stale error of the services", err)
+	}
+	if !r.StaleSince().Equal(stale.Since) {
+		t.Errorf("StaleSince() = %v, want the time of the first watch failure %v", r.StaleSince(), stale.Since)
+	}
+	if got := testutil.ToFloat64(metrics.FetchErrors); got <= fetchErrors {
+		t.Errorf("got %v fetch errors, want more than %v", got, fetchErrors)
+	}
+	if len(ap.Applied()) != 1 {
+		t.Errorf("got %d applies, want the rules to be kept", len(ap.Applied()))
+	}
+
+	// the stale policy applies once the maximum staleness is reached
+	r.now = func() time.Time { return time.Now().Add(time.Minute) }
+	_ = r.Reconcile()
+	if got := len(ap.Current().IngressRules); got != 2 {
+		t.Errorf("got %d rules after the maximum staleness, want the open policy", got)
+	}
+
+	// the caches are up to date again once the services are listed
+	mu.Lock()
+	unreachable = false
+	mu.Unlock()
+	deadline = time.Now().Add(20 * time.Second)
+	for err != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("recovered watch was not noticed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		err = r.Reconcile()
+	}
+	if !r.StaleSince().IsZero() {
+		t.Errorf("StaleSince() = %v, want zero after the watch recovered", r.StaleSince())
+	}
+}
@@ -0,0 +1,242 @@
+// Package status writes the enforcement status of services and network policies back to the objects as
+// annotations and events.
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	k8s "k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+)
+
+const (
+	// AnnotationEnforcement holds the enforcement state of the object: enforced, partial or rejected.
+	AnnotationEnforcement = "firewall.metal-stack.io/enforcement"
+	// AnnotationEnforcementMessage lists the unsupported values of partially enforced objects and the reason
+	// why objects were rejected.
+	AnnotationEnforcementMessage = "firewall.metal-stack.io/enforcement-message"
+	// AnnotationRulesetRevision holds the revision (hash) of the ruleset the enforcement state of the object was
+	// applied in. It is only updated together with the state because the revision changes with every pod.
+	AnnotationRulesetRevision = "firewall.metal-stack.io/ruleset-revision"
+	// KeyRulesetRevision is the key of the status config map that holds the revision (hash) of the ruleset whose
+	// statuses were reported last.
+	KeyRulesetRevision = "ruleset-revision"
+)
+
+const (
+	reasonEnforced          = "FirewallEnforced"
+	reasonPartiallyEnforced = "FirewallPartiallyEnforced"
+	reasonRejected          = "FirewallRejected"
+)
+
+// Reporter writes the enforcement status of the objects the applied rules were assembled from to their
+// annotations and records an event whenever the status of an object changes. Objects are only patched if their
+// own status changed, together with the revision of the ruleset the status was applied in. The revision of the
+// ruleset that was reported last is recorded in the status config map.
+type Reporter struct {
+	client          k8s.Interface
+	logger          *zap.SugaredLogger
+	recorder        record.EventRecorder
+	services        corelisters.ServiceLister
+	networkPolicies networkinglisters.NetworkPolicyLister
+	leading         func() bool
+	namespace       string
+	configMap       string
+	// recorded is the revision that was written to the status config map last
+	recorded string
+}
+
+// NewReporter creates a new Reporter that reads the current annotations from the informers of the factory.
+// If leading is given, only the leader reports so redundant firewalls do not compete for the annotations.
+// The revision of the ruleset is written to the config map in the namespace, it is not recorded if configMap is
+// empty.
+func NewReporter(logger *zap.SugaredLogger, client k8s.Interface, factory informers.SharedInformerFactory, recorder record.EventRecorder, leading func() bool, namespace, configMap string) *Reporter {
+	return &Reporter{
+		client:          client,
+		logger:          logger,
+		recorder:        recorder,
+		services:        factory.Core().V1().Services().Lister(),
+		networkPolicies: factory.Networking().V1().NetworkPolicies().Lister(),
+		leading:         leading,
+		namespace:       namespace,
+		configMap:       configMap,
+	}
+}
+
+// Report writes the statuses of the applied rules, the annotations of objects without status are removed.
+func (r *Reporter) Report(rules *controller.FirewallRules) {
+	if r.leading != nil && !r.leading() {
+		return
+	}
+	revision := rules.Hash()
+	reported := map[controller.Origin]bool{}
+	for _, s := range rules.Statuses {
+		reported[s.Origin] = true
+		obj, annotations, err := r.get(s.Origin)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			r.logger.Errorw("unable to get object to report its status", "object", s.Origin, "error", err)
+			continue
+		}
+		message := message(s)
+		if annotations[AnnotationEnforcement] == string(s.State) && annotations[AnnotationEnforcementMessage] == message {
+			continue
+		}
+		err = r.patch(s.Origin, map[string]interface{}{
+			AnnotationEnforcement:        string(s.State),
+			AnnotationEnforcementMessage: nullIfEmpty(message),
+			AnnotationRulesetRevision:    revision,
+		})
+		if err != nil {
+			r.logger.Errorw("unable to report status", "object", s.Origin, "error", err)
+			continue
+		}
+		r.event(obj, s, revision)
+	}
+	r.clear(reported)
+	r.record(revision)
+}
+
+// record writes the revision to the status config map if it changed, the config map is created if it does not
+// exist.
+func (r *Reporter) record(revision string) {
+	if r.configMap == "" || r.recorded == revision {
+		return
+	}
+	cms := r.client.CoreV1().ConfigMaps(r.namespace)
+	cm, err := cms.Get(context.Background(), r.configMap, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: r.namespace, Name: r.configMap}, Data: map[string]string{KeyRulesetRevision: revision}}
+		_, err = cms.Create(context.Background(), cm, metav1.CreateOptions{})
+	case err == nil && cm.Data[KeyRulesetRevision] != revision:
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[KeyRulesetRevision] = revision
+		_, err = cms.Update(context.Background(), cm, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		r.logger.Errorw("unable to record ruleset revision", "configmap", r.namespace+"/"+r.configMap, "revision", revision, "error", err)
+		return
+	}
+	r.recorded = revision
+}
+
+// clear removes the annotations of objects that are not reported anymore, e.g. services that are not exposed.
+func (r *Reporter) clear(reported map[controller.Origin]bool) {
+	origins := []controller.Origin{}
+	svcs, err := r.services.List(labels.Everything())
+	if err != nil {
+		r.logger.Errorw("unable to list services", "error", err)
+	}
+	for _, svc := range svcs {
+		if _, ok := svc.ObjectMeta.Annotations[AnnotationEnforcement]; ok {
+			origins = append(origins, controller.Origin{Kind: "Service", Namespace: svc.ObjectMeta.Namespace, Name: svc.ObjectMeta.Name})
+		}
+	}
+	nps, err := r.networkPolicies.List(labels.Everything())
+	if err != nil {
+		r.logger.Errorw("unable to list network policies", "error", err)
+	}
+	for _, np := range nps {
+		if _, ok := np.ObjectMeta.Annotations[AnnotationEnforcement]; ok {
+			origins = append(origins, controller.Origin{Kind: "NetworkPolicy", Namespace: np.ObjectMeta.Namespace, Name: np.ObjectMeta.Name})
+		}
+	}
+	for _, o := range origins {
+		if reported[o] {
+			continue
+		}
+		err := r.patch(o, map[string]interface{}{
+			AnnotationEnforcement:        nil,
+			AnnotationEnforcementMessage: nil,
+			AnnotationRulesetRevision:    nil,
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			r.logger.Errorw("unable to remove status", "object", o, "error", err)
+		}
+	}
+}
+
+func (r *Reporter) get(o controller.Origin) (runtime.Object, map[string]string, error) {
+	switch o.Kind {
+	case "Service":
+		svc, err := r.services.Services(o.Namespace).Get(o.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return svc, svc.ObjectMeta.Annotations, nil
+	case "NetworkPolicy":
+		np, err := r.networkPolicies.NetworkPolicies(o.Namespace).Get(o.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return np, np.ObjectMeta.Annotations, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported kind %s", o.Kind)
+}
+
+// patch sets the annotations with a merge patch, annotations with nil values are removed.
+func (r *Reporter) patch(o controller.Origin, annotations map[string]interface{}) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+	switch o.Kind {
+	case "Service":
+		_, err = r.client.CoreV1().Services(o.Namespace).Patch(context.Background(), o.Name, types.MergePatchType, data, metav1.PatchOptions{})
+	case "NetworkPolicy":
+		_, err = r.client.NetworkingV1().NetworkPolicies(o.Namespace).Patch(context.Background(), o.Name, types.MergePatchType, data, metav1.PatchOptions{})
+	default:
+		err = fmt.Errorf("unsupported kind %s", o.Kind)
+	}
+	return err
+}
+
+func (r *Reporter) event(obj runtime.Object, s controller.ObjectStatus, revision string) {
+	switch s.State {
+	case controller.EnforcementEnforced:
+		r.recorder.Eventf(obj, corev1.EventTypeNormal, reasonEnforced, "enforced by the firewall in ruleset revision %s", revision)
+	case controller.EnforcementPartial:
+		r.recorder.Eventf(obj, corev1.EventTypeWarning, reasonPartiallyEnforced, "partially enforced by the firewall in ruleset revision %s, %s", revision, message(s))
+	case controller.EnforcementRejected:
+		r.recorder.Eventf(obj, corev1.EventTypeWarning, reasonRejected, "rejected by the firewall in ruleset revision %s: %s", revision, message(s))
+	}
+}
+
+func message(s controller.ObjectStatus) string {
+	switch s.State {
+	case controller.EnforcementPartial:
+		return "left out unsupported values: " + strings.Join(s.Unsupported, "; ")
+	case controller.EnforcementRejected:
+		return s.Reason
+	}
+	return ""
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,155 @@
+package status
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/metal-stack/firewall-policy-controller/pkg/controller"
+)
+
+func TestReport(t *testing.T) {
+	client := testclient.NewSimpleClientset(
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "internal", Annotations: map[string]string{
+			AnnotationEnforcement:     "enforced",
+			AnnotationRulesetRevision: "0000",
+		}}},
+		&networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "np"}},
+	)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	recorder := record.NewFakeRecorder(10)
+	r := NewReporter(zap.NewNop().Sugar(), client, factory, recorder, nil, "firewall", "status")
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	factory.WaitForCacheSync(stop)
+
+	rules := &controller.FirewallRules{
+		Statuses: []controller.ObjectStatus{
+			{Origin: controller.Origin{Kind: "Service", Namespace: "default", Name: "lb"}, State: controller.EnforcementPartial, Unsupported: []string{"port 53: unsupported protocol foo"}},
+			{Origin: controller.Origin{Kind: "NetworkPolicy", Namespace: "default", Name: "np"}, State: controller.EnforcementRejected, Reason: "invalid network \"10.0.0.0/33\""},
+		},
+	}
+	r.Report(rules)
+
+	svc, err := client.CoreV1().Services("default").Get(context.Background(), "lb", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		AnnotationEnforcement:        "partial",
+		AnnotationEnforcementMessage: "left out unsupported values: port 53: unsupported protocol foo",
+		AnnotationRulesetRevision:    rules.Hash(),
+	}
+	if !reflect.DeepEqual(svc.ObjectMeta.Annotations, want) {
+		t.Errorf("got annotations %v, want %v", svc.ObjectMeta.Annotations, want)
+	}
+	np, err := client.NetworkingV1().NetworkPolicies("default").Get(context.Background(), "np", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if np.ObjectMeta.Annotations[AnnotationEnforcement] != "rejected" || np.ObjectMeta.Annotations[AnnotationEnforcementMessage] != "invalid network \"10.0.0.0/33\"" {
+		t.Errorf("got annotations %v", np.ObjectMeta.Annotations)
+	}
+	internal, err := client.CoreV1().Services("default").Get(context.Background(), "internal", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(internal.ObjectMeta.Annotations) != 0 {
+		t.Errorf("got annotations %v of a service without status", internal.ObjectMeta.Annotations)
+	}
+	if len(recorder.Events) != 2 {
+		t.Errorf("got %d events, want 2", len(recorder.Events))
+	}
+	cm, err := client.CoreV1().ConfigMaps("firewall").Get(context.Background(), "status", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cm.Data[KeyRulesetRevision]; got != rules.Hash() {
+		t.Errorf("got recorded revision %q, want %q", got, rules.Hash())
+	}
+}
+
+// TestReportUnchangedStatus checks that a new revision, e.g. of changed pods, does not patch objects whose status
+// did not change.
+func TestReportUnchangedStatus(t *testing.T) {
+	client := testclient.NewSimpleClientset(&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}})
+	factory := informers.NewSharedInformerFactory(client, 0)
+	r := NewReporter(zap.NewNop().Sugar(), client, factory, record.NewFakeRecorder(10), nil, "firewall", "status")
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	factory.WaitForCacheSync(stop)
+
+	rules := &controller.FirewallRules{
+		Statuses: []controller.ObjectStatus{{Origin: controller.Origin{Kind: "Service", Namespace: "default", Name: "lb"}, State: controller.EnforcementEnforced}},
+	}
+	r.Report(rules)
+	// wait for the informer to see the patched annotations
+	err := wait.PollImmediate(10*time.Millisecond, time.Second, func() (bool, error) {
+		svc, err := factory.Core().V1().Services().Lister().Services("default").Get("lb")
+		return err == nil && svc.ObjectMeta.Annotations[AnnotationEnforcement] != "", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.ClearActions()
+
+	changed := &controller.FirewallRules{
+		Statuses: rules.Statuses,
+		Sets:     []controller.Set{{Family: controller.FamilyIPv4, Name: "np_1", Elements: []string{"10.0.0.1"}}},
+	}
+	r.Report(changed)
+	for _, a := range client.Actions() {
+		if a.GetVerb() == "patch" {
+			t.Errorf("got patch of %s %s although its status did not change", a.GetResource().Resource, a.(k8stesting.PatchAction).GetName())
+		}
+	}
+	svc, err := client.CoreV1().Services("default").Get(context.Background(), "lb", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := svc.ObjectMeta.Annotations[AnnotationRulesetRevision]; got != rules.Hash() {
+		t.Errorf("got revision annotation %q, want the revision %q the status was applied in", got, rules.Hash())
+	}
+	cm, err := client.CoreV1().ConfigMaps("firewall").Get(context.Background(), "status", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cm.Data[KeyRulesetRevision]; got != changed.Hash() {
+		t.Errorf("got recorded revision %q, want %q", got, changed.Hash())
+	}
+}
+
+func TestReportOnlyLeader(t *testing.T) {
+	client := testclient.NewSimpleClientset(&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}})
+	factory := informers.NewSharedInformerFactory(client, 0)
+	r := NewReporter(zap.NewNop().Sugar(), client, factory, record.NewFakeRecorder(10), func() bool { return false }, "", "")
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	factory.WaitForCacheSync(stop)
+
+	r.Report(&controller.FirewallRules{
+		Statuses: []controller.ObjectStatus{{Origin: controller.Origin{Kind: "Service", Namespace: "default", Name: "lb"}, State: controller.EnforcementEnforced}},
+	})
+	svc, err := client.CoreV1().Services("default").Get(context.Background(), "lb", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svc.ObjectMeta.Annotations) != 0 {
+		t.Errorf("follower reported status %v", svc.ObjectMeta.Annotations)
+	}
+}